@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/refraction-networking/conjure/pkg/client/assets"
+	pb "github.com/refraction-networking/conjure/proto"
+	"google.golang.org/protobuf/proto"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+// useClientConf seeds a new asset directory with a copy of the ClientConf
+// in use, and restores it at the end of the test
+func useClientConf(t *testing.T) (string, *pb.ClientConf) {
+	a := assets.Assets()
+	a.RLock()
+	original := proto.Clone(a.GetClientConfPtr()).(*pb.ClientConf)
+	a.RUnlock()
+	dir := t.TempDir()
+	buf, err := proto.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, conjure.ClientConfFile), buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := conjure.SetAssetsDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Also resets the generation that the conjure package expects
+		assets.Assets().SetClientConf(original)
+		conjure.SetAssetsDir(dir)
+	})
+	return dir, original
+}
+
+// checkGenerations checks the generations stored in the asset directory
+func checkGenerations(t *testing.T, dir string, expected map[string]uint32) {
+	t.Helper()
+	for name, generation := range expected {
+		conf := &pb.ClientConf{}
+		buf, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proto.Unmarshal(buf, conf); err != nil {
+			t.Fatal(err)
+		}
+		if conf.GetGeneration() != generation {
+			t.Errorf("expected generation %d in %s, got %d", generation, name, conf.GetGeneration())
+		}
+	}
+}
+
+func TestClientConfFromStation(t *testing.T) {
+	dir, original := useClientConf(t)
+
+	newer := proto.Clone(original).(*pb.ClientConf)
+	newer.Generation = proto.Uint32(original.GetGeneration() + 1)
+	station, err := fakestation.Start(startBridge(t), fakestation.WithClientConf(newer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	conn, err := conjure.Register(&conjure.ConjureConfig{
+		Registrars:    []string{"bdapi"},
+		RegisterURL:   station.URL,
+		Transport:     "min",
+		BridgeAddress: "192.0.2.1:80",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if generation := assets.Assets().GetGeneration(); generation != newer.GetGeneration() {
+		t.Errorf("expected generation %d from the station to be in use, got %d", newer.GetGeneration(), generation)
+	}
+	checkGenerations(t, dir, map[string]uint32{
+		conjure.ClientConfFile:   newer.GetGeneration(),
+		conjure.ClientConfBackup: original.GetGeneration(),
+	})
+}
+
+func TestClientConfNotFromBridgeLine(t *testing.T) {
+	dir, original := useClientConf(t)
+
+	// A bridge line can't replace the ClientConf that every other
+	// connection uses
+	newer := proto.Clone(original).(*pb.ClientConf)
+	newer.Generation = proto.Uint32(0xFFFFFFFF)
+	buf, err := proto.Marshal(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	station, err := fakestation.Start(startBridge(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	config, err := getSOCKSArgs(newSocksConn("192.0.2.1:80", pt.Args{
+		"url":        []string{station.URL},
+		"clientconf": []string{base64.StdEncoding.EncodeToString(buf)},
+	}), &conjure.ConjureConfig{Registrars: []string{"bdapi"}, Transport: "min"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := conjure.Register(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if generation := assets.Assets().GetGeneration(); generation != original.GetGeneration() {
+		t.Errorf("expected generation %d to stay in use, got %d", original.GetGeneration(), generation)
+	}
+	checkGenerations(t, dir, map[string]uint32{conjure.ClientConfFile: original.GetGeneration()})
+}
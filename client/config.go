@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/configfile"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/logging"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+// checkConfig prints the effective configuration to stdout as TOML, and
+// checks the options for each bridge in the config file. The defaults of
+// each client method are checked too, but bridge lines usually supply
+// settings that they are missing, so problems with them are only warnings.
+// The exception is a standalone proxy with a fixed bridge, whose method has
+// to work as it is.
+func checkConfig(stdout, stderr io.Writer, defaults *conjure.ConjureConfig, clientConf string, method string, logOpts logging.Options) error {
+	tables := &configfile.File{Bridges: argsTables(bridgeOptions), Methods: argsTables(methods)}
+	if err := configfile.Print(stdout, flag.CommandLine, tables, commandLineOnly...); err != nil {
+		return err
+	}
+
+	var errs []error
+	if err := logOpts.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if clientConf != "" {
+		if _, err := conjure.ParseClientConf(clientConf); err != nil {
+			errs = append(errs, fmt.Errorf("clientconf: %v", err))
+		}
+	}
+	if _, ok := methods[method]; !ok {
+		errs = append(errs, fmt.Errorf("no such method %s", method))
+	}
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		config, err := methodDefaults(defaults, name)
+		if err == nil {
+			err = config.Validate()
+		}
+		if err == nil {
+			continue
+		}
+		if defaults.BridgeAddress != "" && name == method {
+			errs = append(errs, fmt.Errorf("method %s: %v", name, err))
+		} else {
+			fmt.Fprintf(stderr, "warning: method %s without bridge line arguments: %v\n", name, err)
+		}
+	}
+	addrs := make([]string, 0, len(bridgeOptions))
+	for addr := range bridgeOptions {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		config := defaults.Copy()
+		config.BridgeAddress = addr
+		err := applyArgs(config, bridgeOptions[addr])
+		if err == nil {
+			err = config.Validate()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bridge %s: %v", addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// argsTables converts bridge line arguments to tables for printing
+func argsTables(argsByName map[string]pt.Args) map[string]map[string]string {
+	tables := make(map[string]map[string]string)
+	for name, args := range argsByName {
+		tables[name] = make(map[string]string)
+		for k, v := range args {
+			tables[name][k] = v[0]
+		}
+	}
+	return tables
+}
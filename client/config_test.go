@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/logging"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+// setBridgeOptions sets the per-bridge options of a config file for the
+// rest of the test
+func setBridgeOptions(t *testing.T, options map[string]pt.Args) {
+	bridgeOptions = options
+	t.Cleanup(func() { bridgeOptions = nil })
+}
+
+func TestGetSOCKSArgsBridgeOptions(t *testing.T) {
+	setBridgeOptions(t, map[string]pt.Args{
+		"192.0.2.1:80": {"transport": {"prefix"}, "pool-size": {"2"}},
+	})
+	defaults := &conjure.ConjureConfig{
+		Registrars:  []string{"bdapi"},
+		RegisterURL: "https://default.example",
+		Transport:   "min",
+		PoolMaxAge:  conjure.DefaultPoolMaxAge,
+	}
+
+	// The file overrides the defaults, and the bridge line overrides both
+	config, err := getSOCKSArgs(newSocksConn("192.0.2.1:80", pt.Args{"pool-size": {"1"}}), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Transport != "prefix" || config.PoolSize != 1 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+
+	// Other bridges only get the defaults
+	config, err = getSOCKSArgs(newSocksConn("192.0.2.2:80", nil), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Transport != "min" || config.PoolSize != 0 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defaults := &conjure.ConjureConfig{
+		Registrars: []string{"bdapi"},
+		Transport:  "min",
+	}
+
+	for _, test := range []struct {
+		name    string
+		options map[string]pt.Args
+		logOpts logging.Options
+		err     string
+		warning bool
+	}{
+		{
+			name:    "incomplete defaults",
+			warning: true,
+		},
+		{
+			name: "valid bridge",
+			options: map[string]pt.Args{
+				"192.0.2.1:80": {"url": {"https://a.example"}},
+			},
+			warning: true,
+		},
+		{
+			name: "invalid bridge",
+			options: map[string]pt.Args{
+				"192.0.2.1:80": {"url": {"https://a.example"}},
+				"192.0.2.2:80": {"url": {"https://a.example"}, "transport": {"nope"}},
+			},
+			err:     `bridge 192.0.2.2:80: unknown transport "nope"`,
+			warning: true,
+		},
+		{
+			name:    "invalid log format",
+			logOpts: logging.Options{Format: "xml"},
+			err:     "unknown log format",
+			warning: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setBridgeOptions(t, test.options)
+			var stdout, stderr bytes.Buffer
+			err := checkConfig(&stdout, &stderr, defaults, "", "conjure", test.logOpts)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+			if warned := stderr.Len() > 0; warned != test.warning {
+				t.Errorf("expected warning %v, got %q", test.warning, stderr.String())
+			}
+			for addr := range test.options {
+				if !strings.Contains(stdout.String(), `[bridges."`+addr+`"]`) {
+					t.Errorf("expected %s in the printed configuration:\n%s", addr, stdout.String())
+				}
+			}
+		})
+	}
+}
@@ -2,49 +2,125 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/refraction-networking/conjure/pkg/client/assets"
+	pb "github.com/refraction-networking/conjure/proto"
 	"github.com/refraction-networking/gotapdance/tapdance"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/configfile"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/logging"
 	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
-	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
 )
 
-const RetryInterval = 10 * time.Second
+// Phantom connections registered ahead of time, for bridges that ask for it
+var phantomPool = conjure.NewPhantomPool()
 
-// Get SOCKS arguments and populate config
-func getSOCKSArgs(conn *pt.SocksConn, config *conjure.ConjureConfig) {
-	// Check to see if our command line options are overriden by SOCKS options
-	if arg, ok := conn.Req.Args.Get("registrar"); ok {
-		config.Registrar = arg
+// Numbers SOCKS connections for the session field of status logs
+var sessionIDs atomic.Uint64
+
+// Bridge line arguments for each bridge address, from the config file
+var bridgeOptions map[string]pt.Args
+
+// Flags that can only be given on the command line
+var commandLineOnly = []string{"config", "validate-config"}
+
+// Split a comma-separated list, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Get SOCKS arguments and build a config for this connection. The defaults
+// set on the command line are copied and never modified, so that bridge
+// lines with different arguments do not interfere with each other.
+func getSOCKSArgs(conn *pt.SocksConn, defaults *conjure.ConjureConfig) (*conjure.ConjureConfig, error) {
+	config := defaults.Copy()
+	// In standalone mode the defaults may name the bridge, and the SOCKS
+	// target is only where the application wanted to go
+	if config.BridgeAddress == "" {
+		config.BridgeAddress = conn.Req.Target
+	}
+
+	// Options for this bridge in the config file override the command line,
+	// and SOCKS options override both
+	if args, ok := bridgeOptions[config.BridgeAddress]; ok {
+		if err := applyArgs(config, args); err != nil {
+			return nil, fmt.Errorf("config file options for %s: %v", config.BridgeAddress, err)
+		}
 	}
-	if arg, ok := conn.Req.Args.Get("ampcache"); ok {
+	if err := applyArgs(config, conn.Req.Args); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// applyArgs sets the options in bridge line arguments on config
+func applyArgs(config *conjure.ConjureConfig, args pt.Args) error {
+	// Registrars and transports added to the conjure package may have
+	// arguments of their own
+	if len(args) > 0 && config.Args == nil {
+		config.Args = make(map[string][]string, len(args))
+	}
+	for k, v := range args {
+		config.Args[k] = v
+	}
+	if arg, ok := args.Get("registrar"); ok {
+		config.Registrars = splitList(arg)
+	}
+	if arg, ok := args.Get("registrar-timeout"); ok {
+		timeout, err := time.ParseDuration(arg)
+		if err != nil {
+			return fmt.Errorf("invalid registrar-timeout: %v", err)
+		}
+		config.RegistrarTimeout = timeout
+	}
+	if arg, ok := args.Get("decoy-width"); ok {
+		width, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid decoy-width: %v", err)
+		}
+		config.DecoyWidth = width
+	}
+	if arg, ok := args.Get("ampcache"); ok {
 		config.AMPCacheURL = arg
 	}
-	if arg, ok := conn.Req.Args.Get("url"); ok {
+	if arg, ok := args.Get("url"); ok {
 		config.RegisterURL = arg
 	}
-	if arg, ok := conn.Req.Args.Get("fronts"); ok {
+	if arg, ok := args.Get("fronts"); ok {
 		if arg != "" {
 			config.Fronts = strings.Split(strings.TrimSpace(arg), ",")
 		}
-	} else if arg, ok := conn.Req.Args.Get("front"); ok {
+	} else if arg, ok := args.Get("front"); ok {
 		config.Fronts = strings.Split(strings.TrimSpace(arg), ",")
 	}
-	if arg, ok := conn.Req.Args.Get("utls-nosni"); ok {
+	if arg, ok := args.Get("utls-nosni"); ok {
 		switch strings.ToLower(arg) {
 		case "true":
 			fallthrough
@@ -52,15 +128,87 @@ func getSOCKSArgs(conn *pt.SocksConn, config *conjure.ConjureConfig) {
 			config.UTLSRemoveSNI = true
 		}
 	}
-	if arg, ok := conn.Req.Args.Get("utls-imitate"); ok {
+	if arg, ok := args.Get("utls-imitate"); ok {
 		config.UTLSClientID = arg
 	}
-	if arg, ok := conn.Req.Args.Get("transport"); ok {
+	if arg, ok := args.Get("transport"); ok {
 		config.Transport = arg
 	}
-	if arg, ok := conn.Req.Args.Get("stun"); ok {
+	if arg, ok := args.Get("stun"); ok {
 		config.STUNAddr = arg
 	}
+	if arg, ok := args.Get("phantoms"); ok {
+		config.Phantoms = arg
+	}
+	if arg, ok := args.Get("pool-size"); ok {
+		size, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid pool-size: %v", err)
+		}
+		config.PoolSize = size
+	}
+	if arg, ok := args.Get("pool-max-age"); ok {
+		maxAge, err := time.ParseDuration(arg)
+		if err != nil {
+			return fmt.Errorf("invalid pool-max-age: %v", err)
+		}
+		config.PoolMaxAge = maxAge
+	}
+	for _, retry := range []struct {
+		arg   string
+		value *time.Duration
+	}{
+		{"retry-floor", &config.RetryFloor},
+		{"retry-ceiling", &config.RetryCeiling},
+		{"retry-budget", &config.RetryBudget},
+	} {
+		if arg, ok := args.Get(retry.arg); ok {
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", retry.arg, err)
+			}
+			*retry.value = d
+		}
+	}
+	if arg, ok := args.Get("prefix-id"); ok {
+		prefixes, err := conjure.ParsePrefixes(arg)
+		if err != nil {
+			return fmt.Errorf("invalid prefix-id: %v", err)
+		}
+		config.Prefixes = prefixes
+	}
+	for _, option := range []struct {
+		arg     string
+		value   *bool
+		negated bool
+	}{
+		{"prefix-randomize-port", &config.PrefixDefaultPort, true},
+		{"dtls-randomize-port", &config.DTLSDefaultPort, true},
+		{"dtls-unordered", &config.DTLSUnordered, false},
+		{"udp-check", &config.SkipUDPCheck, true},
+	} {
+		if arg, ok := args.Get(option.arg); ok {
+			switch strings.ToLower(arg) {
+			case "true", "yes":
+				*option.value = !option.negated
+			case "false", "no":
+				*option.value = option.negated
+			default:
+				return fmt.Errorf("invalid %s option %q", option.arg, arg)
+			}
+		}
+	}
+	if arg, ok := args.Get("session"); ok {
+		switch strings.ToLower(arg) {
+		case "true", "yes":
+			config.Session = true
+		case "false", "no":
+			config.Session = false
+		default:
+			return fmt.Errorf("invalid session option %q", arg)
+		}
+	}
+	return nil
 }
 
 // handle the SOCKS conn
@@ -68,62 +216,103 @@ func handler(conn *pt.SocksConn, config *conjure.ConjureConfig) error {
 
 	defer conn.Close()
 
-	shutdown := make(chan struct{})
-
-	bridgeAddr, err := net.ResolveTCPAddr("tcp", conn.Req.Target)
+	bridgeAddr, err := net.ResolveTCPAddr("tcp", config.BridgeAddress)
 	if err != nil {
 		conn.Reject()
 		return err
 	}
-	config.BridgeAddress = conn.Req.Target
-	log.Printf("Attempting to connect to bridge at %s", conn.Req.Target)
+	log.Printf("Attempting to connect to bridge at %s", config.BridgeAddress)
+	config.OnStatus = logStatus(slog.With("session", sessionIDs.Add(1)), config.OnStatus)
 
 	// optimistically grant all incoming SOCKS connections and start buffering data
 	err = conn.Grant(bridgeAddr)
 	if err != nil {
 		return err
 	}
+	dialer, err := conjure.NewDialer(config)
+	if err != nil {
+		return err
+	}
+	dialer.Pool = phantomPool
+
+	if config.Session {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sessConn, err := dialer.DialSession(ctx, config.BridgeAddress)
+		if err != nil {
+			return err
+		}
+		proxy(conn, sessConn)
+		log.Println("Closed session with the bridge")
+		if err := sessConn.Err(); err != nil {
+			pt.Log(pt.LogSeverityWarning, "giving up on conjure bridge, registrations keep failing")
+			return err
+		}
+		return nil
+	}
+
+	// Registration stops as soon as the SOCKS client goes away. Replacing
+	// stale phantoms counts against the same retry budget as failed
+	// registrations.
+	ctx, cancel := context.WithCancel(context.Background())
+	dialCtx := ctx
+	if config.RetryBudget > 0 {
+		var cancelDial context.CancelFunc
+		dialCtx, cancelDial = context.WithTimeout(ctx, config.RetryBudget)
+		defer cancelDial()
+	}
 	buffConn := conjure.NewBufferedConn()
 	reset := make(chan struct{})
 	success := make(chan struct{})
 
 	go func() {
+		backoff := conjure.NewBackoff(config)
 		for {
-			phantomConn, err := conjure.Register(config)
+			phantomConn, err := dialer.DialContext(dialCtx, config.BridgeAddress)
+			if ctx.Err() != nil {
+				log.Println("Registration loop stopped")
+				return
+			} else if err != nil {
+				log.Printf("Giving up on bridge at %s: %s", config.BridgeAddress, err.Error())
+				pt.Log(pt.LogSeverityWarning, "giving up on conjure bridge, registrations keep failing")
+				conn.Close()
+				return
+			}
+			log.Printf("Connected to bridge at %s", config.BridgeAddress)
+			err = buffConn.SetConn(reset, success, phantomConn)
 			if err == nil {
-				log.Printf("Connected to bridge at %s", conn.Req.Target)
-				if err := buffConn.SetConn(reset, success, phantomConn); err != nil {
-					log.Printf("Error setting internal conn: %s", err.Error())
-				} else {
-					log.Printf("Registration successful, checking for staleness. . .")
+				log.Printf("Registration successful, checking for staleness. . .")
+				select {
+				case <-reset:
+					conjure.MarkStale(phantomConn)
+					phantomConn.Close()
+					config.ReportStatus(conjure.Status{Phase: conjure.PhaseStale})
+				case <-success:
+					return
+				case <-ctx.Done():
+					log.Println("Registration loop stopped")
+					return
 				}
 			} else {
-				log.Printf("Error registering with station: %s", err.Error())
-				log.Printf("This may be due to high load, trying again.")
-				pt.Log(pt.LogSeverityNotice,
-					"retrying conjure registration, station is under high load.")
+				log.Printf("Error setting internal conn: %s", err.Error())
+				phantomConn.Close()
 			}
+
+			// Wait before connecting again, as after a failed registration
 			select {
-			case <-time.After(RetryInterval):
-				continue
-			case <-reset:
-				continue
-			case <-success:
-				return
-			case <-shutdown:
-				log.Println("Registration loop stopped")
-				return
+			case <-time.After(backoff.Next()):
+			case <-dialCtx.Done():
 			}
 		}
 	}()
 
 	proxy(conn, buffConn)
 	log.Println("Closed connection to phantom proxy")
-	close(shutdown)
+	cancel()
 	return nil
 }
 
-func acceptLoop(ln *pt.SocksListener, config *conjure.ConjureConfig) error {
+func acceptLoop(ln *pt.SocksListener, defaults *conjure.ConjureConfig) error {
 	defer ln.Close()
 
 	for {
@@ -136,7 +325,13 @@ func acceptLoop(ln *pt.SocksListener, config *conjure.ConjureConfig) error {
 			return err
 		}
 		log.Printf("SOCKS accepted: %v", conn.Req)
-		getSOCKSArgs(conn, config)
+		config, err := getSOCKSArgs(conn, defaults)
+		if err != nil {
+			log.Printf("Invalid bridge line arguments: %s", err.Error())
+			conn.Reject()
+			conn.Close()
+			continue
+		}
 		go func() {
 			err := handler(conn, config)
 			if err != nil {
@@ -174,25 +369,137 @@ func main() {
 	logToStateDir := flag.Bool("log-to-state-dir", false,
 		"resolve the log file relative to tor's pt state dir")
 	unsafeLogging := flag.Bool("unsafe-logging", false, "prevent logs from being scrubbed")
+	logFormat := flag.String("log-format", logging.FormatText, "format of the log: text, or json for one JSON object per line")
 	frontDomainsCommas := flag.String("fronts", "", "comma-separated list of front domains")
-	registrar := flag.String("registrar", "bdapi", "One of bdapi, ampcache, dns")
+	registrar := flag.String("registrar", "bdapi", "comma-separated list of registrars to try in order, from bdapi, ampcache, dns, decoy")
+	registrarTimeout := flag.Duration("registrar-timeout", conjure.DefaultRegistrarTimeout, "time allowed for each registrar before falling back to the next one")
+	decoyWidth := flag.Int("decoy-width", conjure.DefaultDecoyWidth, "number of decoys to send each registration to with the decoy registrar")
 	ampCacheURL := flag.String("ampcache", "", "URL of AMP cache to use as a proxy for signaling, must set registrar to ampcache")
 	registerURL := flag.String("registerURL", "", "URL of the conjure registration station")
 	uTLSClientHelloID := flag.String("utls-imitate", "", "type of TLS client to imitate with utls")
 	uTLSRemoveSNI := flag.Bool("utls-nosni", false, "remove SNI from client hello(ignored if uTLS is not used)")
-	defaultTransport := flag.String("transport", "min", "default transport to connect to phantom proxies")
-	stunAddr := flag.String("stun", "stun.antisip.com:3478", "STUN server address needed for IP retrieval, use with ampCacheURL specified")
+	defaultTransport := flag.String("transport", "min", "default transport to connect to phantom proxies: min, prefix, dtls, a comma-separated list of them to race, or auto")
+	phantoms := flag.String("phantoms", conjure.PhantomsV4, "phantom address families to use, one of v4, v6, both, auto")
+	prefixIDs := flag.String("prefix-id", "", "prefix IDs for the prefix transport to pick from, each with an optional weight, e.g. 5:3,1; any prefix if empty")
+	prefixRandomizePort := flag.Bool("prefix-randomize-port", true, "connect to prefix transport phantoms on a random port rather than the usual port of the prefix")
+	dtlsRandomizePort := flag.Bool("dtls-randomize-port", true, "connect to dtls transport phantoms on a random port rather than port 443")
+	dtlsUnordered := flag.Bool("dtls-unordered", false, "let the dtls transport deliver data out of order")
+	udpCheck := flag.Bool("udp-check", true, "check that UDP gets out through the STUN server before trying the dtls transport, and try it last or not at all if it doesn't")
+	session := flag.Bool("session", false, "keep a session with the bridge across phantom reconnects (the bridge must support it)")
+	stunAddr := flag.String("stun", "stun.antisip.com:3478", "STUN server address needed for IP retrieval with ampCacheURL, and to check that UDP gets out before trying the dtls transport")
+	poolSize := flag.Int("pool-size", 0, "number of phantom connections to register ahead of time for each bridge, 0 to disable")
+	poolMaxAge := flag.Duration("pool-max-age", conjure.DefaultPoolMaxAge, "time after which a pre-registered phantom connection is discarded")
+	retryFloor := flag.Duration("retry-floor", conjure.DefaultRetryFloor, "delay before retrying a failed or stale registration, doubled with each retry")
+	retryCeiling := flag.Duration("retry-ceiling", conjure.DefaultRetryCeiling, "longest delay between registration retries")
+	retryBudget := flag.Duration("retry-budget", conjure.DefaultRetryBudget, "time to keep retrying registrations before giving up on a bridge, 0 for no limit")
+	clientConf := flag.String("clientconf", "", "base64-encoded ClientConf to use if it is newer than the one in the asset directory")
+	listenAddr := flag.String("listen", "", "run as a standalone SOCKS5 proxy on this address instead of being managed by tor")
+	bridge := flag.String("bridge", "", "bridge to connect to in standalone mode, in place of the SOCKS target")
+	method := flag.String("method", "conjure", "client method whose presets to use in standalone mode, e.g. conjure_dtls")
+	configFile := flag.String("config", "", "TOML (.toml) or JSON file of options named like these flags, which override the command line, and of bridge line arguments for each bridge address")
+	validateConfig := flag.Bool("validate-config", false, "print the effective configuration and check it, then exit")
 
 	flag.Parse()
 
-	stateDir, err := pt.MakeStateDir()
+	if *configFile != "" {
+		file, err := configfile.Load(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := file.Apply(flag.CommandLine, commandLineOnly...); err != nil {
+			log.Fatal(err)
+		}
+		if err := addMethods(file.Methods); err != nil {
+			log.Fatalf("%s: %v", *configFile, err)
+		}
+		bridgeOptions = make(map[string]pt.Args)
+		for addr, args := range file.Bridges {
+			bridgeOptions[addr] = make(pt.Args)
+			for k, v := range args {
+				bridgeOptions[addr].Add(k, v)
+			}
+		}
+	}
+
+	standalone := *listenAddr != ""
+	if *bridge != "" {
+		if !standalone {
+			log.Fatal("-bridge can only be used with -listen")
+		}
+		if _, _, err := net.SplitHostPort(*bridge); err != nil {
+			log.Fatalf("invalid bridge address %q: %v", *bridge, err)
+		}
+	}
+
+	var prefixes []conjure.PrefixWeight
+	if *prefixIDs != "" {
+		var err error
+		if prefixes, err = conjure.ParsePrefixes(*prefixIDs); err != nil {
+			log.Fatalf("-prefix-id: %v", err)
+		}
+	}
+
+	var frontDomains []string
+	if *frontDomainsCommas != "" {
+		frontDomains = strings.Split(strings.TrimSpace(*frontDomainsCommas), ",")
+	}
+
+	// Configure Conjure
+	config := &conjure.ConjureConfig{
+		Registrars:        splitList(*registrar),
+		RegistrarTimeout:  *registrarTimeout,
+		DecoyWidth:        *decoyWidth,
+		RegisterURL:       *registerURL,
+		Fronts:            frontDomains,
+		AMPCacheURL:       *ampCacheURL,
+		UTLSClientID:      *uTLSClientHelloID,
+		UTLSRemoveSNI:     *uTLSRemoveSNI,
+		Transport:         *defaultTransport,
+		Prefixes:          prefixes,
+		PrefixDefaultPort: !*prefixRandomizePort,
+		DTLSDefaultPort:   !*dtlsRandomizePort,
+		DTLSUnordered:     *dtlsUnordered,
+		SkipUDPCheck:      !*udpCheck,
+		STUNAddr:          *stunAddr,
+		Phantoms:          *phantoms,
+		Session:           *session,
+		BridgeAddress:     *bridge,
+		PoolSize:          *poolSize,
+		PoolMaxAge:        *poolMaxAge,
+		RetryFloor:        *retryFloor,
+		RetryCeiling:      *retryCeiling,
+		RetryBudget:       *retryBudget,
+	}
+
+	logOpts := logging.Options{Format: *logFormat, Component: "client", Unsafe: *unsafeLogging}
+	if *validateConfig {
+		if err := checkConfig(os.Stdout, os.Stderr, config, *clientConf, *method, logOpts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var inlineClientConf *pb.ClientConf
+	if *clientConf != "" {
+		var err error
+		if inlineClientConf, err = conjure.ParseClientConf(*clientConf); err != nil {
+			log.Fatalf("-clientconf: %v", err)
+		}
+	}
+
+	stateDir, err := makeStateDir(standalone)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Set up logging
+	// Set up logging. Managed by tor, stderr is not shown to anyone, but a
+	// standalone proxy is usually run from a terminal or a script.
 	var logFile io.Writer
 	logFile = io.Discard
+	if standalone {
+		logFile = os.Stderr
+	}
 	if *logFilename != "" {
 		if *logToStateDir {
 			*logFilename = filepath.Join(stateDir, *logFilename)
@@ -204,17 +511,10 @@ func main() {
 		defer f.Close()
 		logFile = f
 	}
-	if !*unsafeLogging {
-		logFile = &safelog.LogScrubber{Output: logFile}
-	}
-	var frontDomains []string
-	if *frontDomainsCommas != "" {
-		frontDomains = strings.Split(strings.TrimSpace(*frontDomainsCommas), ",")
+	if err := logging.Setup(logFile, logOpts); err != nil {
+		log.Fatal(err)
 	}
 
-	log.SetFlags(log.LstdFlags | log.LUTC)
-	log.SetOutput(logFile)
-
 	if *assetDir == "" {
 		*assetDir = stateDir + "conjure"
 		err := os.Mkdir(*assetDir, 0755)
@@ -222,53 +522,43 @@ func main() {
 			log.Fatal(err)
 		}
 	}
-	assets.AssetsSetDir(*assetDir)
-	tapdance.SetLoggerOutput(logFile)
-	tapdance.Logger().Warnf("Redirecting log to file")
-
-	// Configure Conjure
-	config := &conjure.ConjureConfig{
-		Registrar:     *registrar,
-		RegisterURL:   *registerURL,
-		Fronts:        frontDomains,
-		AMPCacheURL:   *ampCacheURL,
-		UTLSClientID:  *uTLSClientHelloID,
-		UTLSRemoveSNI: *uTLSRemoveSNI,
-		Transport:     *defaultTransport,
-		STUNAddr:      *stunAddr,
-	}
-
-	// Tor client-side transport setup
-	var ln *pt.SocksListener
-	ptInfo, err := pt.ClientSetup(nil)
-	if err != nil {
+	if err := conjure.SetAssetsDir(*assetDir); err != nil {
 		log.Fatal(err)
 	}
-	if ptInfo.ProxyURL != nil {
-		pt.ProxyError("proxy is not supported")
-		os.Exit(1)
+	if inlineClientConf != nil {
+		// Registration still works with the ClientConf in use
+		if err := conjure.AdoptClientConf(inlineClientConf); err != nil {
+			log.Printf("Error adopting the ClientConf from -clientconf: %s", err.Error())
+		}
+	}
+	if err := logging.SetupLogrus(tapdance.Logger(), logFile, "tapdance", logOpts); err != nil {
+		log.Fatal(err)
 	}
+	tapdance.Logger().Warnf("Redirecting log to file")
 
-	for _, methodName := range ptInfo.MethodNames {
-		switch methodName {
-		case "conjure":
-			ln, err = pt.ListenSocks("tcp", "127.0.0.1:0")
-			if err != nil {
-				pt.CmethodError(methodName, err.Error())
-				break
-			}
-			log.Printf("Started SOCKS listener at %v", ln.Addr())
-			go acceptLoop(ln, config)
-			pt.Cmethod(methodName, ln.Version(), ln.Addr())
-		default:
-			pt.CmethodError(methodName, "no such method")
+	var listeners []*pt.SocksListener
+	if standalone {
+		methodConfig, err := methodDefaults(config, *method)
+		if err != nil {
+			log.Fatalf("method %s: %v", *method, err)
+		}
+		ln, err := pt.ListenSocks("tcp", *listenAddr)
+		if err != nil {
+			log.Fatal(err)
 		}
+		log.Printf("Started standalone SOCKS listener for %s at %v", *method, ln.Addr())
+		go acceptLoop(ln, methodConfig)
+		listeners = append(listeners, ln)
+	} else {
+		listeners = setupManagedProxy(config, *unsafeLogging)
 	}
-	pt.CmethodsDone()
 
 	// shutdown handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM)
+	if standalone {
+		signal.Notify(sigChan, os.Interrupt)
+	}
 
 	// https://gitweb.torproject.org/torspec.git/tree/pt-spec.txt#n203
 	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
@@ -283,5 +573,69 @@ func main() {
 
 	<-sigChan
 	log.Println("shutting down conjure")
-	ln.Close()
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	phantomPool.Close()
+}
+
+// makeStateDir returns the directory in which to keep state, ending in a
+// path separator. Tor provides one to managed proxies, and a standalone
+// proxy falls back to the user's cache directory.
+func makeStateDir(standalone bool) (string, error) {
+	if !standalone || os.Getenv("TOR_PT_STATE_LOCATION") != "" {
+		return pt.MakeStateDir()
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	stateDir := filepath.Join(cacheDir, "conjure-pt") + string(filepath.Separator)
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", err
+	}
+	return stateDir, nil
+}
+
+// setupManagedProxy speaks tor's managed proxy protocol and starts a SOCKS
+// listener for each client method that tor asked for, with the defaults of
+// that method
+func setupManagedProxy(config *conjure.ConjureConfig, unsafeLogging bool) []*pt.SocksListener {
+	var listeners []*pt.SocksListener
+	ptInfo, err := pt.ClientSetup(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ptInfo.ProxyURL != nil {
+		config.ProxyURL = ptInfo.ProxyURL
+		if err := config.ValidateProxy(); err != nil {
+			pt.ProxyError(err.Error())
+			os.Exit(1)
+		}
+		pt.ProxyDone()
+		log.Printf("Using upstream proxy %s", ptInfo.ProxyURL.Redacted())
+	}
+
+	for _, methodName := range ptInfo.MethodNames {
+		methodConfig, err := methodDefaults(config, methodName)
+		if err == nil {
+			err = methodConfig.ValidateProxy()
+		}
+		if err != nil {
+			pt.CmethodError(methodName, err.Error())
+			continue
+		}
+		methodConfig.OnStatus = ptStatus(methodName, unsafeLogging)
+		ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+		if err != nil {
+			pt.CmethodError(methodName, err.Error())
+			continue
+		}
+		log.Printf("Started SOCKS listener for %s at %v", methodName, ln.Addr())
+		go acceptLoop(ln, methodConfig)
+		pt.Cmethod(methodName, ln.Version(), ln.Addr())
+		listeners = append(listeners, ln)
+	}
+	pt.CmethodsDone()
+	return listeners
 }
@@ -0,0 +1,57 @@
+package conjure
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultRetryFloor is the delay before the first retry of a failed
+	// or stale registration
+	DefaultRetryFloor = 5 * time.Second
+	// DefaultRetryCeiling is the longest delay between retries
+	DefaultRetryCeiling = 2 * time.Minute
+	// DefaultRetryBudget is how long to keep retrying before giving up on
+	// a bridge
+	DefaultRetryBudget = 10 * time.Minute
+)
+
+// Backoff produces jittered, exponentially growing delays between
+// registration attempts
+type Backoff struct {
+	floor    time.Duration
+	ceiling  time.Duration
+	attempts int
+}
+
+// NewBackoff returns a Backoff with the floor and ceiling in config, or the
+// defaults for those that are not set
+func NewBackoff(config *ConjureConfig) *Backoff {
+	b := &Backoff{floor: config.RetryFloor, ceiling: config.RetryCeiling}
+	if b.floor <= 0 {
+		b.floor = DefaultRetryFloor
+	}
+	if b.ceiling <= 0 {
+		b.ceiling = max(DefaultRetryCeiling, b.floor)
+	}
+	return b
+}
+
+// Next returns the delay before the next attempt. The delay doubles from
+// the floor with each attempt until it reaches the ceiling, and is then
+// drawn at random from between half of it and all of it.
+func (b *Backoff) Next() time.Duration {
+	delay := b.ceiling
+	if b.attempts < 32 {
+		if d := b.floor << b.attempts; d > 0 && d < delay {
+			delay = d
+		}
+	}
+	b.attempts++
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Reset starts the delays over from the floor
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
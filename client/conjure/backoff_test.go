@@ -0,0 +1,40 @@
+package conjure
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(&ConjureConfig{RetryFloor: time.Second, RetryCeiling: 10 * time.Second})
+	for _, max := range []time.Duration{1, 2, 4, 8, 10, 10, 10} {
+		max *= time.Second
+		if d := b.Next(); d < max/2 || d > max {
+			t.Errorf("expected a delay between %v and %v, got %v", max/2, max, d)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d > time.Second {
+		t.Errorf("expected the delay to start over after a reset, got %v", d)
+	}
+
+	// Many attempts should not overflow
+	for i := 0; i < 100; i++ {
+		b.Next()
+	}
+	if d := b.Next(); d < 5*time.Second || d > 10*time.Second {
+		t.Errorf("expected the delay to stay at the ceiling, got %v", d)
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	b := NewBackoff(&ConjureConfig{})
+	if b.floor != DefaultRetryFloor || b.ceiling != DefaultRetryCeiling {
+		t.Errorf("expected the default floor and ceiling, got %v and %v", b.floor, b.ceiling)
+	}
+	// A floor above the default ceiling raises the ceiling
+	b = NewBackoff(&ConjureConfig{RetryFloor: 5 * time.Minute})
+	if b.ceiling != 5*time.Minute {
+		t.Errorf("expected the ceiling to be raised to the floor, got %v", b.ceiling)
+	}
+}
@@ -51,9 +51,15 @@ func (c *BufferedConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// Close closes the current connection, and ends reads that are waiting
+// for one
 func (c *BufferedConn) Close() error {
-	if c.conn != nil {
-		return c.conn.Close()
+	c.rp.Close()
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+	if conn != nil {
+		return conn.Close()
 	}
 	return nil
 }
@@ -0,0 +1,249 @@
+package conjure
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/refraction-networking/conjure/pkg/client/assets"
+	pb "github.com/refraction-networking/conjure/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// ClientConfFile is the name of the ClientConf in the asset directory
+	ClientConfFile = "ClientConf"
+	// ClientConfBackup is the name of the copy of the previous generation
+	// of the ClientConf, kept in case the current one becomes unreadable
+	ClientConfBackup = "ClientConf.prev"
+)
+
+// defaultClientConf is a known-good ClientConf built into the client. It is
+// seeded into an asset directory that has no usable ClientConf, so that a
+// fresh install does not fall back to the library's minimal defaults. It is
+// generation 1165, from the assets of gotapdance v1.7.10; see the client
+// README for how to refresh it.
+//
+//go:embed assets/ClientConf
+var defaultClientConf []byte
+
+// clientConfs tracks the ClientConf generation in use. The station sends a
+// newer generation in its registration responses, which the conjure library
+// adopts and writes to the asset directory. After each registration, the new
+// generation is read back and checked, and the previous one is kept as a
+// backup, or restored if the check fails.
+var clientConfs struct {
+	sync.Mutex
+	dir  string
+	conf *pb.ClientConf
+}
+
+// SetAssetsDir makes the conjure library use the ClientConf in dir. If that
+// ClientConf can't be parsed, the previous generation kept in
+// ClientConfBackup is restored. Without either, the ClientConf built into the
+// client is written to dir.
+//
+// The library writes the ClientConfs it adopts in place, so a crash while it
+// does leaves a truncated file behind. Rolling back here is what recovers
+// from that.
+func SetAssetsDir(dir string) error {
+	path := filepath.Join(dir, ClientConfFile)
+	if _, err := loadClientConf(path); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading ClientConf: %s", err.Error())
+		}
+		if backup, err := loadClientConf(filepath.Join(dir, ClientConfBackup)); err == nil {
+			if err := writeClientConf(path, backup); err != nil {
+				return err
+			}
+			log.Printf("Rolled back to ClientConf generation %d", backup.GetGeneration())
+		} else {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("No usable ClientConf backup: %s", err.Error())
+			}
+			if err := writeFile(path, defaultClientConf); err != nil {
+				return err
+			}
+			log.Printf("Seeded the asset directory with the built-in ClientConf")
+		}
+	}
+
+	a, err := assets.AssetsSetDir(dir)
+	if a == nil {
+		return err
+	}
+	clientConfs.Lock()
+	defer clientConfs.Unlock()
+	clientConfs.dir = dir
+	a.RLock()
+	clientConfs.conf = proto.Clone(a.GetClientConfPtr()).(*pb.ClientConf)
+	a.RUnlock()
+	log.Printf("Using ClientConf generation %d", clientConfs.conf.GetGeneration())
+	return nil
+}
+
+// checkClientConf checks a ClientConf generation that the library adopted
+// since the last check, and either keeps the previous one as a backup or
+// rolls back to it
+func checkClientConf() {
+	clientConfs.Lock()
+	defer clientConfs.Unlock()
+	if clientConfs.dir == "" {
+		return
+	}
+	checkClientConfLocked("the station")
+}
+
+// checkClientConfLocked is checkClientConf with clientConfs locked, logging
+// where a new generation came from
+func checkClientConfLocked(source string) {
+	previous := clientConfs.conf
+	generation := assets.Assets().GetGeneration()
+	if generation == previous.GetGeneration() {
+		return
+	}
+
+	conf, err := readClientConf(filepath.Join(clientConfs.dir, ClientConfFile))
+	if err == nil {
+		err = verifyClientConf(conf, previous.GetGeneration())
+	}
+	if err == nil && conf.GetGeneration() != generation {
+		err = fmt.Errorf("generation %d was written instead of %d", conf.GetGeneration(), generation)
+	}
+	if err != nil {
+		log.Printf("Error adopting ClientConf generation %d, rolling back to %d: %s",
+			generation, previous.GetGeneration(), err.Error())
+		if err := assets.Assets().SetClientConf(proto.Clone(previous).(*pb.ClientConf)); err != nil {
+			log.Printf("Error rolling back ClientConf: %s", err.Error())
+		}
+		return
+	}
+
+	// The library wrote the file in place, so write it again through a
+	// temporary file. Until then, the backup written on the last adoption
+	// is what SetAssetsDir rolls back to.
+	if err := writeClientConf(filepath.Join(clientConfs.dir, ClientConfFile), conf); err != nil {
+		log.Printf("Error rewriting ClientConf: %s", err.Error())
+	}
+
+	if err := writeClientConf(filepath.Join(clientConfs.dir, ClientConfBackup), previous); err != nil {
+		log.Printf("Error keeping a backup of the previous ClientConf: %s", err.Error())
+	}
+	log.Printf("Adopted ClientConf generation %d from %s", generation, source)
+	clientConfs.conf = conf
+}
+
+// ParseClientConf decodes a base64-encoded ClientConf, as given with the
+// -clientconf flag, and checks the settings that registrations depend on.
+// The padding may be left out.
+func ParseClientConf(encoded string) (*pb.ClientConf, error) {
+	buf, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(encoded), "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ClientConf encoding: %v", err)
+	}
+	conf := &pb.ClientConf{}
+	if err := proto.Unmarshal(buf, conf); err != nil {
+		return nil, fmt.Errorf("invalid ClientConf: %v", err)
+	}
+	if err := verifyClientConf(conf, 0); err != nil {
+		return nil, fmt.Errorf("invalid ClientConf: %v", err)
+	}
+	return conf, nil
+}
+
+// AdoptClientConf makes the library use conf, as returned by
+// ParseClientConf, if it is a newer generation than the one in use. It is
+// stored, checked and backed up like a ClientConf from the station, and is
+// used for all later registrations, so it should only come from the user's
+// own configuration. SetAssetsDir must be called first.
+func AdoptClientConf(conf *pb.ClientConf) error {
+	clientConfs.Lock()
+	defer clientConfs.Unlock()
+	if clientConfs.dir == "" {
+		return errors.New("no asset directory to store the ClientConf in")
+	}
+	if conf.GetGeneration() <= assets.Assets().GetGeneration() {
+		return nil
+	}
+	if err := assets.Assets().SetClientConf(conf); err != nil {
+		return err
+	}
+	checkClientConfLocked("the -clientconf option")
+	return nil
+}
+
+// verifyClientConf checks that conf is a newer generation than previous, with
+// the settings that registrations depend on
+func verifyClientConf(conf *pb.ClientConf, previous uint32) error {
+	if conf.GetGeneration() <= previous {
+		return fmt.Errorf("generation %d is not newer than %d", conf.GetGeneration(), previous)
+	}
+	if key := conf.GetConjurePubkey().GetKey(); key != nil && len(key) != 32 {
+		return fmt.Errorf("station public key has %d bytes, expected 32", len(key))
+	}
+	return nil
+}
+
+// loadClientConf reads the ClientConf at path and checks that it can be
+// used. A file that was truncated to nothing still parses, as a ClientConf
+// without a generation, which is why it is checked as well.
+func loadClientConf(path string) (*pb.ClientConf, error) {
+	conf, err := readClientConf(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyClientConf(conf, 0); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return conf, nil
+}
+
+func readClientConf(path string) (*pb.ClientConf, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &pb.ClientConf{}
+	if err := proto.Unmarshal(buf, conf); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return conf, nil
+}
+
+// writeClientConf writes conf to path through a temporary file, so that a
+// crash never leaves a partly written ClientConf behind
+func writeClientConf(path string, conf *pb.ClientConf) error {
+	buf, err := proto.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, buf)
+}
+
+// writeFile writes buf to path through a temporary file
+func writeFile(path string, buf []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,226 @@
+package conjure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/refraction-networking/conjure/pkg/client/assets"
+	pb "github.com/refraction-networking/conjure/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// testClientConf returns a copy of the ClientConf in use with the given
+// generation
+func testClientConf(generation uint32) *pb.ClientConf {
+	a := assets.Assets()
+	a.RLock()
+	conf := proto.Clone(a.GetClientConfPtr()).(*pb.ClientConf)
+	a.RUnlock()
+	conf.Generation = proto.Uint32(generation)
+	return conf
+}
+
+// useAssetsDir calls SetAssetsDir on a new asset directory with files in
+// it, and restores the ClientConf in use at the end of the test
+func useAssetsDir(t *testing.T, files map[string][]byte) string {
+	original := testClientConf(assets.Assets().GetGeneration())
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetAssetsDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		clientConfs.Lock()
+		clientConfs.dir = ""
+		clientConfs.Unlock()
+		assets.Assets().SetClientConf(original)
+	})
+	return dir
+}
+
+func marshalClientConf(t *testing.T, generation uint32) []byte {
+	buf, err := proto.Marshal(testClientConf(generation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// checkGeneration checks the generation of the ClientConf in use, and of the
+// one stored in the named file
+func checkGeneration(t *testing.T, dir, name string, expected uint32) {
+	t.Helper()
+	if name == ClientConfFile {
+		if generation := assets.Assets().GetGeneration(); generation != expected {
+			t.Errorf("expected generation %d to be in use, got %d", expected, generation)
+		}
+	}
+	conf, err := readClientConf(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.GetGeneration() != expected {
+		t.Errorf("expected generation %d in %s, got %d", expected, name, conf.GetGeneration())
+	}
+}
+
+func TestSetAssetsDirRollback(t *testing.T) {
+	dir := useAssetsDir(t, map[string][]byte{
+		ClientConfFile:   []byte("not a ClientConf"),
+		ClientConfBackup: marshalClientConf(t, 4),
+	})
+	checkGeneration(t, dir, ClientConfFile, 4)
+}
+
+func TestCheckClientConf(t *testing.T) {
+	dir := useAssetsDir(t, map[string][]byte{ClientConfFile: marshalClientConf(t, 5)})
+	checkGeneration(t, dir, ClientConfFile, 5)
+
+	// Nothing changes without a new generation
+	checkClientConf()
+	if _, err := os.Stat(filepath.Join(dir, ClientConfBackup)); err == nil {
+		t.Error("expected no backup before an update")
+	}
+
+	// As the library does with a ClientConf from the station
+	if err := assets.Assets().SetClientConf(testClientConf(6)); err != nil {
+		t.Fatal(err)
+	}
+	checkClientConf()
+	checkGeneration(t, dir, ClientConfFile, 6)
+	checkGeneration(t, dir, ClientConfBackup, 5)
+}
+
+func TestCheckClientConfRollback(t *testing.T) {
+	for name, corrupt := range map[string]func(t *testing.T, dir string){
+		"unreadable": func(t *testing.T, dir string) {
+			if err := os.WriteFile(filepath.Join(dir, ClientConfFile), []byte("not a ClientConf"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"invalid key": func(t *testing.T, dir string) {
+			conf := testClientConf(6)
+			conf.ConjurePubkey = &pb.PubKey{Key: []byte("short")}
+			if err := assets.Assets().SetClientConf(conf); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := useAssetsDir(t, map[string][]byte{ClientConfFile: marshalClientConf(t, 5)})
+			if err := assets.Assets().SetClientConf(testClientConf(6)); err != nil {
+				t.Fatal(err)
+			}
+			corrupt(t, dir)
+			checkClientConf()
+			checkGeneration(t, dir, ClientConfFile, 5)
+			if _, err := os.Stat(filepath.Join(dir, ClientConfBackup)); err == nil {
+				t.Error("expected no backup after a rollback")
+			}
+		})
+	}
+}
+
+func TestSetAssetsDirSeed(t *testing.T) {
+	dir := useAssetsDir(t, nil)
+	buf, err := os.ReadFile(filepath.Join(dir, ClientConfFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, defaultClientConf) {
+		t.Error("expected the built-in ClientConf to be seeded")
+	}
+	conf := &pb.ClientConf{}
+	if err := proto.Unmarshal(defaultClientConf, conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.GetDecoyList().GetTlsDecoys()) == 0 || conf.GetDnsRegConf() == nil {
+		t.Error("expected the built-in ClientConf to have decoys and DNS registrar settings")
+	}
+	checkGeneration(t, dir, ClientConfFile, conf.GetGeneration())
+}
+
+func TestParseClientConf(t *testing.T) {
+	buf := marshalClientConf(t, 7)
+	for _, encoded := range []string{
+		base64.StdEncoding.EncodeToString(buf),
+		base64.RawStdEncoding.EncodeToString(buf),
+	} {
+		conf, err := ParseClientConf(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.GetGeneration() != 7 {
+			t.Errorf("expected generation 7, got %d", conf.GetGeneration())
+		}
+	}
+
+	for _, encoded := range []string{
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte("not a ClientConf")),
+		base64.StdEncoding.EncodeToString(marshalClientConf(t, 0)),
+	} {
+		if _, err := ParseClientConf(encoded); err == nil {
+			t.Errorf("expected an error for %q", encoded)
+		}
+	}
+}
+
+func TestAdoptClientConf(t *testing.T) {
+	dir := useAssetsDir(t, map[string][]byte{ClientConfFile: marshalClientConf(t, 5)})
+
+	if err := AdoptClientConf(testClientConf(7)); err != nil {
+		t.Fatal(err)
+	}
+	checkGeneration(t, dir, ClientConfFile, 7)
+	checkGeneration(t, dir, ClientConfBackup, 5)
+
+	// An older generation is ignored
+	if err := AdoptClientConf(testClientConf(6)); err != nil {
+		t.Fatal(err)
+	}
+	checkGeneration(t, dir, ClientConfFile, 7)
+	checkGeneration(t, dir, ClientConfBackup, 5)
+}
+
+func TestSetAssetsDirTruncated(t *testing.T) {
+	for name, size := range map[string]func(n int) int{
+		"empty":     func(n int) int { return 0 },
+		"truncated": func(n int) int { return n - 1 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := useAssetsDir(t, map[string][]byte{ClientConfFile: marshalClientConf(t, 5)})
+			if err := assets.Assets().SetClientConf(testClientConf(6)); err != nil {
+				t.Fatal(err)
+			}
+			checkClientConf()
+			checkGeneration(t, dir, ClientConfBackup, 5)
+
+			// As a crash while the library writes the next generation would
+			path := filepath.Join(dir, ClientConfFile)
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, buf[:size(len(buf))], 0600); err != nil {
+				t.Fatal(err)
+			}
+			// The library only reads the ClientConf again for another
+			// directory, as it would after a restart
+			if err := SetAssetsDir(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			if err := SetAssetsDir(dir); err != nil {
+				t.Fatal(err)
+			}
+			checkGeneration(t, dir, ClientConfFile, 5)
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package conjure
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ConjureConfig holds the settings used for a single connection to a
+// Conjure bridge. A config is built once per SOCKS connection and must
+// not be modified after it has been passed to Register.
+type ConjureConfig struct {
+	Registrars        []string      // registrars to try, in order of preference
+	RegistrarTimeout  time.Duration // time allowed for each registrar before falling back
+	RegisterURL       string        // URL of the conjure bidirectional registration API endpoint
+	Fronts            []string
+	AMPCacheURL       string
+	BridgeAddress     string // IP address of the Tor Conjure PT bridge
+	UTLSClientID      string
+	UTLSRemoveSNI     bool
+	Transport         string // transport, comma-separated list of transports to race, or auto
+	STUNAddr          string
+	ProxyURL          *url.URL            // upstream proxy for registration and phantom connections
+	Phantoms          string              // phantom address families: v4, v6, both or auto
+	Session           bool                // use the session layer to survive phantom reconnects
+	PoolSize          int                 // phantom connections to register ahead of time, 0 to disable
+	PoolMaxAge        time.Duration       // how long a pre-registered phantom connection is kept
+	RetryFloor        time.Duration       // first delay between registration attempts
+	RetryCeiling      time.Duration       // longest delay between registration attempts
+	RetryBudget       time.Duration       // time to keep retrying before giving up, 0 for no limit
+	Prefixes          []PrefixWeight      // prefixes for the prefix transport to pick from, any if empty
+	PrefixDefaultPort bool                // connect to the usual port of the prefix rather than a random one
+	DTLSUnordered     bool                // let the dtls transport deliver data out of order
+	DTLSDefaultPort   bool                // connect to dtls phantoms on port 443 rather than a random one
+	SkipUDPCheck      bool                // try dtls without first checking that UDP gets out through STUNAddr
+	DecoyWidth        int                 // decoys to send each decoy registration to, 0 for DefaultDecoyWidth
+	Args              map[string][]string // all bridge line arguments, for registrars and transports added with RegisterRegistrar and RegisterTransport
+	OnStatus          func(Status)        // called as connecting to the bridge progresses, may be nil
+}
+
+// Copy returns a deep copy of the config, so that the copy can be
+// modified without affecting other connections that share the original.
+func (c *ConjureConfig) Copy() *ConjureConfig {
+	config := *c
+	if c.Registrars != nil {
+		config.Registrars = make([]string, len(c.Registrars))
+		copy(config.Registrars, c.Registrars)
+	}
+	if c.Fronts != nil {
+		config.Fronts = make([]string, len(c.Fronts))
+		copy(config.Fronts, c.Fronts)
+	}
+	if c.Args != nil {
+		config.Args = make(map[string][]string, len(c.Args))
+		for k, v := range c.Args {
+			config.Args[k] = append([]string(nil), v...)
+		}
+	}
+	if c.Prefixes != nil {
+		config.Prefixes = make([]PrefixWeight, len(c.Prefixes))
+		copy(config.Prefixes, c.Prefixes)
+	}
+	return &config
+}
+
+// Validate checks that the config describes a registrar and transport that
+// we know how to use, and that all settings they depend on are present.
+func (c *ConjureConfig) Validate() error {
+	// A registrar that cannot be used with this config is skipped when the
+	// fallback chain is built, so the config is only invalid if none of
+	// them can be used.
+	if len(c.Registrars) == 0 {
+		return errors.New("no registrar selected")
+	}
+	var errs []error
+	for _, registrar := range c.Registrars {
+		if err := c.checkRegistrar(registrar); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(c.Registrars) {
+		return errors.Join(errs...)
+	}
+	if c.RegistrarTimeout < 0 {
+		return fmt.Errorf("invalid registrar timeout %v", c.RegistrarTimeout)
+	}
+	if c.DecoyWidth < 0 || c.DecoyWidth > MaxDecoyWidth {
+		return fmt.Errorf("invalid decoy width %d, must be between 0 and %d", c.DecoyWidth, MaxDecoyWidth)
+	}
+
+	for _, name := range c.transports() {
+		if _, ok := lookupTransport(name); !ok {
+			return fmt.Errorf("unknown transport %q", name)
+		}
+	}
+
+	for _, p := range c.Prefixes {
+		if err := p.check(); err != nil {
+			return err
+		}
+	}
+
+	switch c.Phantoms {
+	case "", PhantomsV4, PhantomsV6, PhantomsBoth, PhantomsAuto:
+	default:
+		return fmt.Errorf("unknown phantoms option %q", c.Phantoms)
+	}
+
+	if c.PoolSize < 0 || c.PoolSize > MaxPoolSize {
+		return fmt.Errorf("invalid pool size %d, must be between 0 and %d", c.PoolSize, MaxPoolSize)
+	}
+	if c.PoolSize > 0 && c.PoolMaxAge <= 0 {
+		return fmt.Errorf("invalid pool max age %v", c.PoolMaxAge)
+	}
+
+	if c.RetryFloor < 0 || c.RetryCeiling < 0 || c.RetryBudget < 0 {
+		return errors.New("retry delays and budget must not be negative")
+	}
+	if c.RetryFloor > 0 && c.RetryCeiling > 0 && c.RetryCeiling < c.RetryFloor {
+		return fmt.Errorf("retry ceiling %v is below the retry floor %v", c.RetryCeiling, c.RetryFloor)
+	}
+
+	if c.ProxyURL != nil {
+		if err := c.ValidateProxy(); err != nil {
+			return err
+		}
+	}
+
+	if c.BridgeAddress != "" {
+		if _, _, err := net.SplitHostPort(c.BridgeAddress); err != nil {
+			return fmt.Errorf("invalid bridge address %q: %v", c.BridgeAddress, err)
+		}
+	}
+	return nil
+}
+
+// ValidateProxy checks that the upstream proxy is supported, and that the
+// transport and at least one of the registrars can be used through it.
+// Unlike Validate, it does not require the settings that are usually given
+// on the bridge line, so it can be used to check the command line defaults.
+func (c *ConjureConfig) ValidateProxy() error {
+	if c.ProxyURL == nil {
+		return nil
+	}
+	if _, err := NewProxyDialer(c.ProxyURL); err != nil {
+		return err
+	}
+	// UDP cannot be sent through the upstream proxy
+	if names := c.transports(); len(filterTransports(names, TransportSpec.proxyOK)) == 0 {
+		return fmt.Errorf("%s transport cannot be used through a proxy", strings.Join(names, ","))
+	}
+	// The uTLS round tripper only takes a proxy URL, which it can only use
+	// for SOCKS5 proxies
+	if c.UTLSClientID != "" && c.ProxyURL.Scheme != "socks5" {
+		return fmt.Errorf("utls-imitate cannot be used through a %s proxy", c.ProxyURL.Scheme)
+	}
+	if c.ProxyURL.Scheme == "socks4a" && c.Phantoms == PhantomsV6 {
+		return errors.New("IPv6 phantoms cannot be reached through a socks4a proxy")
+	}
+	var errs []error
+	for _, registrar := range c.Registrars {
+		if err := proxyRegistrarError(registrar); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(c.Registrars) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// transports returns the transports to race, in order of preference. An
+// empty Transport means min, and auto means all of them.
+func (c *ConjureConfig) transports() []string {
+	switch c.Transport {
+	case "":
+		return []string{"min"}
+	case TransportAuto:
+		return AutoTransports
+	}
+	var names []string
+	for _, name := range strings.Split(c.Transport, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkRegistrar reports whether the named registrar can be used with
+// this config.
+func (c *ConjureConfig) checkRegistrar(name string) error {
+	spec, ok := lookupRegistrar(name)
+	if !ok {
+		return fmt.Errorf("unknown registrar %q", name)
+	}
+	if spec.Validate != nil {
+		if err := spec.Validate(c); err != nil {
+			return err
+		}
+	}
+	if c.ProxyURL != nil {
+		return proxyRegistrarError(name)
+	}
+	return nil
+}
+
+// proxyRegistrarError reports whether the named registrar can't be used
+// through an upstream proxy
+func proxyRegistrarError(name string) error {
+	if spec, ok := lookupRegistrar(name); ok && !spec.proxyOK() {
+		return fmt.Errorf("%s registrar cannot be used through a proxy", name)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package conjure
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestConfigCopy(t *testing.T) {
+	orig := &ConjureConfig{
+		Registrars:  []string{"bdapi"},
+		RegisterURL: "https://registration.example",
+		Fronts:      []string{"front1.example", "front2.example"},
+		Transport:   "min",
+		Args:        map[string][]string{"transport": {"min"}},
+	}
+	c := orig.Copy()
+	c.Args["transport"][0] = "prefix"
+	c.Registrars[0] = "dns"
+	c.Fronts[0] = "other.example"
+	c.Transport = "prefix"
+	c.BridgeAddress = "192.0.2.1:80"
+
+	if orig.Registrars[0] != "bdapi" {
+		t.Errorf("copy modified original registrars: %v", orig.Registrars)
+	}
+	if orig.Fronts[0] != "front1.example" {
+		t.Errorf("copy modified original fronts: %v", orig.Fronts)
+	}
+	if orig.Args["transport"][0] != "min" {
+		t.Errorf("copy modified original args: %v", orig.Args)
+	}
+	if orig.Transport != "min" || orig.BridgeAddress != "" {
+		t.Errorf("copy modified original fields: %+v", orig)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config ConjureConfig
+		valid  bool
+	}{
+		{
+			name:   "api",
+			config: ConjureConfig{Registrars: []string{"bdapi"}, RegisterURL: "https://r.example"},
+			valid:  true,
+		},
+		{
+			name:   "api without url",
+			config: ConjureConfig{Registrars: []string{"bdapi"}},
+		},
+		{
+			name:   "ampcache without cache url",
+			config: ConjureConfig{Registrars: []string{"ampcache"}, RegisterURL: "https://r.example"},
+		},
+		{
+			name: "chain with an unusable entry",
+			config: ConjureConfig{
+				Registrars:  []string{"bdapi", "ampcache", "carrier-pigeon"},
+				RegisterURL: "https://r.example",
+			},
+			valid: true,
+		},
+		{
+			name:   "chain with no usable entry",
+			config: ConjureConfig{Registrars: []string{"bdapi", "ampcache"}},
+		},
+		{
+			name:   "dns",
+			config: ConjureConfig{Registrars: []string{"dns"}, Transport: "dtls"},
+			valid:  true,
+		},
+		{
+			name:   "decoy",
+			config: ConjureConfig{Registrars: []string{"decoy"}, DecoyWidth: 3},
+			valid:  true,
+		},
+		{
+			name:   "invalid decoy width",
+			config: ConjureConfig{Registrars: []string{"decoy"}, DecoyWidth: MaxDecoyWidth + 1},
+		},
+		{
+			name:   "no registrar",
+			config: ConjureConfig{RegisterURL: "https://r.example"},
+		},
+		{
+			name:   "unknown registrar",
+			config: ConjureConfig{Registrars: []string{"carrier-pigeon"}},
+		},
+		{
+			name:   "unknown transport",
+			config: ConjureConfig{Registrars: []string{"dns"}, Transport: "udp"},
+		},
+		{
+			name:   "unknown prefix",
+			config: ConjureConfig{Registrars: []string{"dns"}, Transport: "prefix", Prefixes: []PrefixWeight{{ID: 1000, Weight: 1}}},
+		},
+		{
+			name:   "transport list",
+			config: ConjureConfig{Registrars: []string{"dns"}, Transport: "prefix,min"},
+			valid:  true,
+		},
+		{
+			name:   "auto transport",
+			config: ConjureConfig{Registrars: []string{"dns"}, Transport: "auto"},
+			valid:  true,
+		},
+		{
+			name:   "transport list with an unknown transport",
+			config: ConjureConfig{Registrars: []string{"dns"}, Transport: "prefix,udp"},
+		},
+		{
+			name:   "bad bridge address",
+			config: ConjureConfig{Registrars: []string{"dns"}, BridgeAddress: "192.0.2.1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Validate()
+			if test.valid && err != nil {
+				t.Errorf("expected valid config, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected invalid config")
+			}
+		})
+	}
+}
+
+func TestConfigValidateProxy(t *testing.T) {
+	proxyURL, err := url.Parse("socks5://127.0.0.1:9050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		config ConjureConfig
+		valid  bool
+	}{
+		{
+			// The registration URL usually comes from the bridge line
+			name:   "defaults without url",
+			config: ConjureConfig{Registrars: []string{"bdapi"}, Transport: "prefix"},
+			valid:  true,
+		},
+		{
+			name:   "dtls",
+			config: ConjureConfig{Registrars: []string{"bdapi"}, Transport: "dtls"},
+		},
+		{
+			name:   "transport list with dtls",
+			config: ConjureConfig{Registrars: []string{"bdapi"}, Transport: "dtls,min"},
+			valid:  true,
+		},
+		{
+			name:   "auto transport",
+			config: ConjureConfig{Registrars: []string{"bdapi"}, Transport: "auto"},
+			valid:  true,
+		},
+		{
+			name:   "udp registrars only",
+			config: ConjureConfig{Registrars: []string{"dns", "ampcache"}},
+		},
+		{
+			name:   "chain with one usable registrar",
+			config: ConjureConfig{Registrars: []string{"dns", "bdapi"}},
+			valid:  true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.ProxyURL = proxyURL
+			err := test.config.ValidateProxy()
+			if test.valid && err != nil {
+				t.Errorf("expected valid config, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected invalid config")
+			}
+		})
+	}
+
+	unsupported := ConjureConfig{Registrars: []string{"bdapi"}, ProxyURL: &url.URL{Scheme: "https", Host: "127.0.0.1:443"}}
+	if err := unsupported.ValidateProxy(); err == nil {
+		t.Error("expected unsupported proxy scheme to be rejected")
+	}
+}
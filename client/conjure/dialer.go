@@ -0,0 +1,84 @@
+package conjure
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Dialer connects to Conjure bridges, for programs that use the client as a
+// library. It registers with the registrars in its config, races the
+// transports in it, and retries failed registrations with backoff until the
+// retry budget is spent.
+type Dialer struct {
+	// Pool, if set, supplies pre-registered phantom connections for configs
+	// with a PoolSize
+	Pool *PhantomPool
+
+	config *ConjureConfig
+}
+
+// NewDialer returns a Dialer that connects with the settings in config. The
+// bridge address is given to DialContext, so config doesn't need one. config
+// is copied, and can be changed afterwards without affecting the Dialer.
+func NewDialer(config *ConjureConfig) (*Dialer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Dialer{config: config.Copy()}, nil
+}
+
+// DialContext connects to the bridge at bridgeAddr through a phantom. It
+// keeps registering until a phantom connection is made, or until the next
+// attempt would start after the retry budget of the config or the deadline
+// of ctx. Once ctx is done, the registration or phantom dial in progress is
+// abandoned, and DialContext returns ctx.Err() right away. The connection
+// that is returned is not affected by ctx.
+func (d *Dialer) DialContext(ctx context.Context, bridgeAddr string) (net.Conn, error) {
+	if _, _, err := net.SplitHostPort(bridgeAddr); err != nil {
+		return nil, fmt.Errorf("invalid bridge address %q: %v", bridgeAddr, err)
+	}
+	config := d.config.Copy()
+	config.BridgeAddress = bridgeAddr
+
+	backoff := NewBackoff(config)
+	start := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		var err error
+		if d.Pool != nil {
+			conn, err = d.Pool.GetContext(ctx, config)
+		} else {
+			conn, err = RegisterContext(ctx, config)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// Give up once the next attempt would start too late, so that the
+		// caller can try another bridge
+		delay := backoff.Next()
+		next := time.Now().Add(delay)
+		deadline, hasDeadline := ctx.Deadline()
+		if (config.RetryBudget > 0 && next.Sub(start) > config.RetryBudget) || (hasDeadline && next.After(deadline)) {
+			return nil, fmt.Errorf("giving up on bridge at %s after %v: %w", bridgeAddr, time.Since(start).Round(time.Second), err)
+		}
+		log.Printf("Error registering with station: %s", err.Error())
+		log.Printf("This may be due to high load, trying again in %v", delay.Round(time.Second))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package conjure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+)
+
+func TestNewDialer(t *testing.T) {
+	if _, err := NewDialer(&ConjureConfig{}); err == nil {
+		t.Error("expected a config without registrars to be rejected")
+	}
+	config := &ConjureConfig{Registrars: []string{"dns"}}
+	d, err := NewDialer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Registrars[0] = "bdapi"
+	if d.config.Registrars[0] != "dns" {
+		t.Error("expected the dialer to keep its own copy of the config")
+	}
+	if _, err := d.DialContext(context.Background(), "192.0.2.1"); err == nil {
+		t.Error("expected a bridge address without a port to be rejected")
+	}
+}
+
+func TestDialer(t *testing.T) {
+	station, err := fakestation.Start("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	var bridges []string
+	d, err := NewDialer(&ConjureConfig{
+		Registrars:  []string{"bdapi"},
+		RegisterURL: station.URL,
+		OnStatus: func(s Status) {
+			if s.Phase == PhaseConnected {
+				bridges = append(bridges, s.Bridge)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(bridges) != 1 || bridges[0] != "192.0.2.1:80" {
+		t.Errorf("expected to connect to 192.0.2.1:80, connected to %v", bridges)
+	}
+}
+
+func TestDialerRetryBudget(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	d, err := NewDialer(&ConjureConfig{
+		Registrars:   []string{"bdapi"},
+		RegisterURL:  server.URL,
+		RetryFloor:   10 * time.Millisecond,
+		RetryCeiling: 20 * time.Millisecond,
+		RetryBudget:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := d.DialContext(context.Background(), "192.0.2.1:80"); err == nil {
+		t.Fatal("expected to give up on the bridge")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to give up after the retry budget, took %v", elapsed)
+	}
+	if n := requests.Load(); n < 2 {
+		t.Errorf("expected registrations to be retried, got %d", n)
+	}
+}
+
+func TestDialerCancel(t *testing.T) {
+	// A registration server that doesn't answer until the test ends
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	d, err := NewDialer(&ConjureConfig{Registrars: []string{"bdapi"}, RegisterURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := d.DialContext(ctx, "192.0.2.1:80")
+		errs <- err
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("registration did not start")
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the dial to be canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the dial to return as soon as it was canceled")
+	}
+}
+
+func TestDialSessionRetryBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	d, err := NewDialer(&ConjureConfig{
+		Registrars:   []string{"bdapi"},
+		RegisterURL:  server.URL,
+		RetryFloor:   10 * time.Millisecond,
+		RetryCeiling: 20 * time.Millisecond,
+		RetryBudget:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialSession(context.Background(), "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Reads end once the session is closed for running out of budget
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected the read to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to be closed after the retry budget")
+	}
+	if err := conn.Err(); err == nil || errors.Is(err, errSessionClosed) {
+		t.Errorf("expected the registration error, got %v", err)
+	}
+}
+
+func TestDialSessionCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	d, err := NewDialer(&ConjureConfig{Registrars: []string{"bdapi"}, RegisterURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := d.DialSession(ctx, "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cancel()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected the session to be closed once canceled")
+	}
+	if err := conn.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the session to be canceled, got %v", err)
+	}
+
+	// Closing the session isn't an error
+	conn, err = d.DialSession(context.Background(), "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := conn.Err(); err != nil {
+		t.Errorf("expected no error after Close, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package conjure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	pb "github.com/refraction-networking/conjure/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Time allowed for a STUN server to answer the UDP reachability check
+	udpCheckTimeout = 2 * time.Second
+	// Time between STUN requests during the check, in case one is lost
+	udpCheckResend = 500 * time.Millisecond
+	// How long the result of a UDP reachability check is kept
+	udpCheckTTL = time.Minute
+)
+
+// UDP reachability check results by STUN server address
+var udpChecks = struct {
+	sync.Mutex
+	results map[string]udpCheckResult
+}{results: make(map[string]udpCheckResult)}
+
+type udpCheckResult struct {
+	err     error
+	checked time.Time
+}
+
+// dtlsParams returns the parameters to register the dtls transport with
+func (c *ConjureConfig) dtlsParams() *pb.DTLSTransportParams {
+	return &pb.DTLSTransportParams{
+		RandomizeDstPort: proto.Bool(!c.DTLSDefaultPort),
+		Unordered:        proto.Bool(c.DTLSUnordered),
+	}
+}
+
+// checkUDPTransports checks that UDP gets out before the transports that
+// need it, such as dtls, are tried, so that a network that blocks UDP does
+// not cost a whole registration. If it doesn't, those transports are moved
+// to the end of names and a PhaseUDPBlocked status is reported, or an error
+// is returned if there is no other transport to try.
+func (c *ConjureConfig) checkUDPTransports(ctx context.Context, names []string) ([]string, error) {
+	others := withoutUDP(names)
+	if c.SkipUDPCheck || c.STUNAddr == "" || len(others) == len(names) {
+		return names, nil
+	}
+	err := checkUDP(ctx, c.STUNAddr)
+	if err == nil {
+		return names, nil
+	}
+	var udp []string
+	for _, name := range names {
+		if !slices.Contains(others, name) {
+			udp = append(udp, name)
+		}
+	}
+	if len(others) == 0 {
+		err = fmt.Errorf("UDP seems to be blocked, not trying the %s transport: %w", strings.Join(udp, ","), err)
+		c.ReportStatus(Status{Phase: PhaseFailed, Transport: strings.Join(udp, ","), Err: err})
+		return nil, err
+	}
+	c.ReportStatus(Status{Phase: PhaseUDPBlocked, Transport: strings.Join(udp, ","), Err: err})
+	return append(others, udp...), nil
+}
+
+// checkUDP reports whether the STUN server at addr answers a binding
+// request. The result is kept for udpCheckTTL, and other connections wait
+// for a check that is in progress.
+func checkUDP(ctx context.Context, addr string) error {
+	udpChecks.Lock()
+	defer udpChecks.Unlock()
+	if result, ok := udpChecks.results[addr]; ok && time.Since(result.checked) < udpCheckTTL {
+		return result.err
+	}
+	err := stunBinding(ctx, addr)
+	if ctx.Err() != nil {
+		// Don't keep the result of a check that was cut short
+		return err
+	}
+	udpChecks.results[addr] = udpCheckResult{err: err, checked: time.Now()}
+	return err
+}
+
+// stunBinding sends STUN binding requests to addr until one is answered or
+// udpCheckTimeout passes
+func stunBinding(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, udpCheckTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(udpCheckResend)
+		defer ticker.Stop()
+		for {
+			if _, err := conn.Write(req.Raw); err != nil {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("no answer from STUN server within %v", udpCheckTimeout)
+			}
+			return err
+		}
+		resp := &stun.Message{Raw: buf[:n]}
+		if err := resp.Decode(); err != nil || resp.TransactionID != req.TransactionID {
+			continue
+		}
+		if resp.Type != stun.BindingSuccess {
+			return errors.New("STUN binding request failed")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,123 @@
+package conjure
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+)
+
+// closedUDPAddr returns a loopback address that nothing listens on
+func closedUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestDTLSParams(t *testing.T) {
+	params := (&ConjureConfig{}).dtlsParams()
+	if !params.GetRandomizeDstPort() || params.GetUnordered() {
+		t.Errorf("expected ordered delivery on a random port by default, got %v", params)
+	}
+	params = (&ConjureConfig{DTLSUnordered: true, DTLSDefaultPort: true}).dtlsParams()
+	if params.GetRandomizeDstPort() || !params.GetUnordered() {
+		t.Errorf("expected unordered delivery on the default port, got %v", params)
+	}
+}
+
+func TestCheckUDPTransports(t *testing.T) {
+	station, err := fakestation.Start("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+	blocked := closedUDPAddr(t)
+
+	for _, test := range []struct {
+		name     string
+		config   ConjureConfig
+		names    []string
+		expected []string
+		phase    string
+	}{
+		{
+			name:     "reachable",
+			config:   ConjureConfig{STUNAddr: station.STUNAddr},
+			names:    []string{"dtls", "min"},
+			expected: []string{"dtls", "min"},
+		},
+		{
+			name:     "blocked",
+			config:   ConjureConfig{STUNAddr: blocked},
+			names:    []string{"dtls", "min", "prefix"},
+			expected: []string{"min", "prefix", "dtls"},
+			phase:    PhaseUDPBlocked,
+		},
+		{
+			name:   "blocked dtls only",
+			config: ConjureConfig{STUNAddr: blocked},
+			names:  []string{"dtls"},
+			phase:  PhaseFailed,
+		},
+		{
+			name:     "check skipped",
+			config:   ConjureConfig{STUNAddr: blocked, SkipUDPCheck: true},
+			names:    []string{"dtls", "min"},
+			expected: []string{"dtls", "min"},
+		},
+		{
+			name:     "no dtls",
+			config:   ConjureConfig{STUNAddr: closedUDPAddr(t)},
+			names:    []string{"min", "prefix"},
+			expected: []string{"min", "prefix"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var statuses []Status
+			test.config.OnStatus = func(s Status) { statuses = append(statuses, s) }
+			names, err := test.config.checkUDPTransports(context.Background(), test.names)
+			if test.phase == "" && len(statuses) > 0 {
+				t.Errorf("expected no status, got %+v", statuses)
+			} else if test.phase != "" && (len(statuses) != 1 || statuses[0].Phase != test.phase || statuses[0].Transport != "dtls") {
+				t.Errorf("expected a %s status for dtls, got %+v", test.phase, statuses)
+			}
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("expected an error, got %v", names)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(names, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, names)
+			}
+		})
+	}
+}
+
+func TestCheckUDPCache(t *testing.T) {
+	station, err := fakestation.Start("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := station.STUNAddr
+	if err := checkUDP(context.Background(), addr); err != nil {
+		t.Fatal(err)
+	}
+	station.Close()
+	// The result of the first check is kept
+	if err := checkUDP(context.Background(), addr); err != nil {
+		t.Errorf("expected the cached result, got %v", err)
+	}
+	if err := checkUDP(context.Background(), closedUDPAddr(t)); err == nil {
+		t.Error("expected an error without a STUN server")
+	}
+}
@@ -0,0 +1,139 @@
+package conjure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/gotapdance/tapdance"
+)
+
+const DefaultRegistrarTimeout = 30 * time.Second
+
+const (
+	// DefaultDecoyWidth is the number of decoys that a decoy registration is
+	// sent to, as in TapDance
+	DefaultDecoyWidth = 5
+	// MaxDecoyWidth limits the number of decoys a registration is sent to
+	MaxDecoyWidth = 20
+)
+
+// preferredRegistrars remembers, for each ordered list of registrars, the
+// registrar that last succeeded. Later connections that use the same list
+// try that registrar first.
+var preferredRegistrars = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+type namedRegistrar struct {
+	name      string
+	registrar tapdance.Registrar
+}
+
+// fallbackRegistrar tries each of its registrars in order, giving each of
+// them at most timeout to complete a registration, until one succeeds.
+type fallbackRegistrar struct {
+	key        string
+	registrars []namedRegistrar
+	timeout    time.Duration
+	status     func(Status)       // reports fallbacks and the registrar used, may be nil
+	v4Filter   *ipv4PhantomFilter // told the IPv4 phantom to refuse, for IPv6 phantoms only
+}
+
+func newFallbackRegistrar(config *ConjureConfig, client *http.Client) (*fallbackRegistrar, error) {
+	var registrars []namedRegistrar
+	for _, name := range config.Registrars {
+		if err := config.checkRegistrar(name); err != nil {
+			log.Printf("Skipping %s registrar: %s", name, err.Error())
+			continue
+		}
+		registrar, err := newRegistrar(name, config, client)
+		if err != nil {
+			log.Printf("Unable to create %s registrar: %s", name, err.Error())
+			continue
+		}
+		registrars = append(registrars, namedRegistrar{name: name, registrar: registrar})
+	}
+	key := strings.Join(config.Registrars, ",")
+	if len(registrars) == 0 {
+		return nil, fmt.Errorf("unable to create any of the registrars %s", key)
+	}
+	fallback := newFallbackChain(key, registrars, config.RegistrarTimeout)
+	fallback.status = config.ReportStatus
+	return fallback, nil
+}
+
+// newFallbackChain orders the registrars so that the one that last succeeded
+// for the same list (identified by key) is tried first.
+func newFallbackChain(key string, registrars []namedRegistrar, timeout time.Duration) *fallbackRegistrar {
+	if timeout <= 0 {
+		timeout = DefaultRegistrarTimeout
+	}
+
+	preferredRegistrars.Lock()
+	preferred := preferredRegistrars.m[key]
+	preferredRegistrars.Unlock()
+
+	fallback := &fallbackRegistrar{key: key, timeout: timeout}
+	for _, r := range registrars {
+		if r.name == preferred {
+			fallback.registrars = append([]namedRegistrar{r}, fallback.registrars...)
+		} else {
+			fallback.registrars = append(fallback.registrars, r)
+		}
+	}
+	return fallback
+}
+
+// PrepareRegKeys prepares the key materials of every registrar in the list
+func (f *fallbackRegistrar) PrepareRegKeys(stationPubkey [32]byte, sessionSecret []byte) error {
+	var errs []error
+	for _, r := range f.registrars {
+		if err := r.registrar.PrepareRegKeys(stationPubkey, sessionSecret); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *fallbackRegistrar) Register(cjSession *tapdance.ConjureSession, ctx context.Context) (*tapdance.ConjureReg, error) {
+	var errs []error
+	for i, r := range f.registrars {
+		if i > 0 {
+			log.Printf("Falling back to %s registrar", r.name)
+			f.reportStatus(Status{Phase: PhaseFallback, Registrar: r.name, Err: errs[len(errs)-1]})
+		}
+		regCtx, cancel := context.WithTimeout(ctx, f.timeout)
+		reg, err := r.registrar.Register(cjSession, regCtx)
+		cancel()
+		if err == nil {
+			log.Printf("Registered through %s registrar", r.name)
+			f.reportStatus(Status{Phase: PhaseRegistered, Registrar: r.name})
+			if f.v4Filter != nil {
+				f.v4Filter.registered(reg)
+			}
+			preferredRegistrars.Lock()
+			preferredRegistrars.m[f.key] = r.name
+			preferredRegistrars.Unlock()
+			return reg, nil
+		}
+		log.Printf("Error registering through %s registrar: %s", r.name, err.Error())
+		errs = append(errs, fmt.Errorf("%s: %w", r.name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (f *fallbackRegistrar) reportStatus(s Status) {
+	if f.status != nil {
+		f.status(s)
+	}
+}
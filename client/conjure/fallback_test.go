@@ -0,0 +1,140 @@
+package conjure
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/refraction-networking/gotapdance/tapdance"
+)
+
+// stubRegistrar succeeds, fails or blocks until its context is done
+type stubRegistrar struct {
+	result string
+	calls  int
+}
+
+func (r *stubRegistrar) PrepareRegKeys(stationPubkey [32]byte, sessionSecret []byte) error {
+	return nil
+}
+
+func (r *stubRegistrar) Register(cjSession *tapdance.ConjureSession, ctx context.Context) (*tapdance.ConjureReg, error) {
+	r.calls++
+	switch r.result {
+	case "succeed":
+		return &tapdance.ConjureReg{}, nil
+	case "block":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	default:
+		return nil, errors.New("registration failed")
+	}
+}
+
+func TestFallbackRegistrar(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		results []string
+		cancel  bool     // cancel the parent context while the first registrar blocks
+		calls   []int    // expected number of calls to each registrar
+		success bool     // expected outcome
+		order   []string // expected order of a new chain with the same key
+	}{
+		{
+			name:    "first succeeds",
+			results: []string{"succeed", "fail"},
+			calls:   []int{1, 0},
+			success: true,
+			order:   []string{"r0", "r1"},
+		},
+		{
+			name:    "fall through failures",
+			results: []string{"fail", "fail", "succeed"},
+			calls:   []int{1, 1, 1},
+			success: true,
+			order:   []string{"r2", "r0", "r1"},
+		},
+		{
+			name:    "fall through timeout",
+			results: []string{"block", "succeed"},
+			calls:   []int{1, 1},
+			success: true,
+			order:   []string{"r1", "r0"},
+		},
+		{
+			name:    "all fail",
+			results: []string{"fail", "block"},
+			calls:   []int{1, 1},
+			order:   []string{"r0", "r1"},
+		},
+		{
+			name:    "parent context done",
+			results: []string{"block", "succeed"},
+			cancel:  true,
+			calls:   []int{1, 0},
+			order:   []string{"r0", "r1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stubs := make([]*stubRegistrar, len(test.results))
+			var registrars []namedRegistrar
+			for i, result := range test.results {
+				stubs[i] = &stubRegistrar{result: result}
+				registrars = append(registrars, namedRegistrar{
+					name:      "r" + string(rune('0'+i)),
+					registrar: stubs[i],
+				})
+			}
+			key := t.Name()
+			fallback := newFallbackChain(key, registrars, 50*time.Millisecond)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			_, err := fallback.Register(nil, ctx)
+			if test.success && err != nil {
+				t.Errorf("expected success, got %v", err)
+			}
+			if !test.success && err == nil {
+				t.Errorf("expected failure")
+			}
+			for i, stub := range stubs {
+				if stub.calls != test.calls[i] {
+					t.Errorf("registrar %d called %d times, expected %d", i, stub.calls, test.calls[i])
+				}
+			}
+
+			next := newFallbackChain(key, registrars, 0)
+			if next.timeout != DefaultRegistrarTimeout {
+				t.Errorf("expected default timeout, got %v", next.timeout)
+			}
+			for i, r := range next.registrars {
+				if r.name != test.order[i] {
+					t.Errorf("expected order %v, got %v", test.order, next.registrars)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestFallbackRegistrarStatus(t *testing.T) {
+	registrars := []namedRegistrar{
+		{name: "r0", registrar: &stubRegistrar{result: "fail"}},
+		{name: "r1", registrar: &stubRegistrar{result: "succeed"}},
+	}
+	fallback := newFallbackChain(t.Name(), registrars, time.Second)
+	var statuses []Status
+	fallback.status = func(s Status) { statuses = append(statuses, s) }
+	if _, err := fallback.Register(nil, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 ||
+		statuses[0].Phase != PhaseFallback || statuses[0].Registrar != "r1" || statuses[0].Err == nil ||
+		statuses[1].Phase != PhaseRegistered || statuses[1].Registrar != "r1" {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+}
@@ -0,0 +1,149 @@
+package conjure
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/refraction-networking/gotapdance/tapdance"
+)
+
+// Phantom address families that can be selected with the phantoms option
+const (
+	PhantomsV4   = "v4"
+	PhantomsV6   = "v6"
+	PhantomsBoth = "both"
+	PhantomsAuto = "auto"
+)
+
+// ipv6CheckInterval is how long the result of the IPv6 connectivity check
+// is reused before checking again
+const ipv6CheckInterval = 5 * time.Minute
+
+// ipv6ProbeAddr is a well-known global IPv6 address. Connecting a UDP socket
+// to it does not send any packets, but fails if there is no route.
+var ipv6ProbeAddr = "[2001:4860:4860::8888]:53"
+
+var ipv6Check = struct {
+	sync.Mutex
+	checked time.Time
+	ok      bool
+}{}
+
+// hasIPv6 reports whether the host has a route to the IPv6 internet from
+// a global unicast address.
+func hasIPv6() bool {
+	ipv6Check.Lock()
+	defer ipv6Check.Unlock()
+	if time.Since(ipv6Check.checked) < ipv6CheckInterval {
+		return ipv6Check.ok
+	}
+	ipv6Check.ok = probeIPv6(ipv6ProbeAddr)
+	ipv6Check.checked = time.Now()
+	return ipv6Check.ok
+}
+
+func probeIPv6(addr string) bool {
+	conn, err := net.Dial("udp6", addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && local.IP.To4() == nil && local.IP.IsGlobalUnicast()
+}
+
+// phantomFamily decides which phantom address families to use for the
+// config. IPv6 phantoms are only used if the host has IPv6 connectivity,
+// otherwise we fall back to IPv4 phantoms.
+func phantomFamily(config *ConjureConfig) string {
+	switch config.Phantoms {
+	case PhantomsV6, PhantomsBoth, PhantomsAuto:
+	default:
+		return PhantomsV4
+	}
+	if config.ProxyURL != nil {
+		// We can't check the connectivity of the proxy, so only use IPv6
+		// phantoms if they were explicitly asked for
+		if config.Phantoms == PhantomsAuto {
+			return PhantomsV4
+		}
+		return config.Phantoms
+	}
+	if !hasIPv6() {
+		log.Printf("No IPv6 connectivity, falling back to IPv4 phantoms")
+		return PhantomsV4
+	}
+	if config.Phantoms == PhantomsAuto {
+		return PhantomsBoth
+	}
+	return config.Phantoms
+}
+
+// ipv4PhantomFilter keeps tapdance from connecting to the IPv4 phantom of a
+// registration. tapdance registers and dials both IPv4 and IPv6 phantoms when
+// IPv6 is supported, so this is how only the IPv6 one is used. Registrars
+// connect through the same dialer, the decoy registrar to IPv4 decoys, so
+// only the phantom that the registration returned is refused.
+type ipv4PhantomFilter struct {
+	lock    sync.Mutex
+	phantom net.IP
+}
+
+// registered takes the IPv4 phantom to refuse from reg
+func (f *ipv4PhantomFilter) registered(reg *tapdance.ConjureReg) {
+	phantom := phantom4(reg)
+	f.lock.Lock()
+	f.phantom = phantom
+	f.lock.Unlock()
+}
+
+// wrap returns a dialer that connects with dialer, except to the IPv4
+// phantom
+func (f *ipv4PhantomFilter) wrap(dialer func(context.Context, string, string, string) (net.Conn, error)) func(context.Context, string, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, laddr, raddr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(raddr)
+		if err != nil {
+			return nil, err
+		}
+		f.lock.Lock()
+		phantom := f.phantom
+		f.lock.Unlock()
+		if ip := net.ParseIP(host); ip != nil && phantom != nil && ip.Equal(phantom) {
+			return nil, fmt.Errorf("not connecting to IPv4 phantom %s, only IPv6 phantoms are allowed", host)
+		}
+		return dialer(ctx, network, laddr, raddr)
+	}
+}
+
+// phantom4 returns the IPv4 phantom of reg, or nil if it has none.
+// ConjureReg.Phantom4 dereferences the address without checking it.
+func phantom4(reg *tapdance.ConjureReg) (phantom net.IP) {
+	defer func() {
+		if recover() != nil {
+			phantom = nil
+		}
+	}()
+	return reg.Phantom4()
+}
+
+// defaultDialer is used by tapdance when no other dialer is set
+func defaultDialer(ctx context.Context, network, laddr, raddr string) (net.Conn, error) {
+	d := net.Dialer{}
+	if laddr != "" {
+		var err error
+		switch network {
+		case "udp", "udp4", "udp6":
+			d.LocalAddr, err = net.ResolveUDPAddr(network, laddr)
+		default:
+			d.LocalAddr, err = net.ResolveTCPAddr(network, laddr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error resolving laddr: %v", err)
+		}
+	}
+	return d.DialContext(ctx, network, raddr)
+}
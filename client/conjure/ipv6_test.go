@@ -0,0 +1,86 @@
+package conjure
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/refraction-networking/conjure/proto"
+	"github.com/refraction-networking/gotapdance/tapdance"
+	"google.golang.org/protobuf/proto"
+)
+
+func setIPv6(ok bool) {
+	ipv6Check.Lock()
+	defer ipv6Check.Unlock()
+	ipv6Check.ok = ok
+	ipv6Check.checked = time.Now()
+}
+
+func TestPhantomFamily(t *testing.T) {
+	proxyURL := &url.URL{Scheme: "socks5", Host: "127.0.0.1:9050"}
+	for _, test := range []struct {
+		phantoms string
+		ipv6     bool
+		proxy    bool
+		family   string
+	}{
+		{"", true, false, PhantomsV4},
+		{PhantomsV4, true, false, PhantomsV4},
+		{PhantomsV6, true, false, PhantomsV6},
+		{PhantomsV6, false, false, PhantomsV4},
+		{PhantomsBoth, true, false, PhantomsBoth},
+		{PhantomsBoth, false, false, PhantomsV4},
+		{PhantomsAuto, true, false, PhantomsBoth},
+		{PhantomsAuto, false, false, PhantomsV4},
+		{PhantomsAuto, true, true, PhantomsV4},
+		{PhantomsV6, false, true, PhantomsV6},
+	} {
+		setIPv6(test.ipv6)
+		config := &ConjureConfig{Phantoms: test.phantoms}
+		if test.proxy {
+			config.ProxyURL = proxyURL
+		}
+		if family := phantomFamily(config); family != test.family {
+			t.Errorf("phantoms=%q ipv6=%v proxy=%v: expected %s, got %s",
+				test.phantoms, test.ipv6, test.proxy, test.family, family)
+		}
+	}
+}
+
+func TestIPv4PhantomFilter(t *testing.T) {
+	var dialed []string
+	filter := &ipv4PhantomFilter{}
+	dialer := filter.wrap(func(ctx context.Context, network, laddr, raddr string) (net.Conn, error) {
+		dialed = append(dialed, raddr)
+		return nil, nil
+	})
+
+	// Registrars, like the decoy registrar, reach IPv4 addresses through
+	// the same dialer
+	if _, err := dialer(context.Background(), "tcp", "", "192.0.2.1:443"); err != nil {
+		t.Errorf("expected IPv4 decoy to be dialed, got %v", err)
+	}
+	filter.registered(&tapdance.ConjureReg{})
+
+	reg := &tapdance.ConjureReg{}
+	if err := reg.UnpackRegResp(&pb.RegistrationResponse{Ipv4Addr: proto.Uint32(0xc0000202)}); err != nil {
+		t.Fatal(err)
+	}
+	filter.registered(reg)
+	if _, err := dialer(context.Background(), "tcp", "", "192.0.2.2:443"); err == nil {
+		t.Error("expected IPv4 phantom to be refused")
+	}
+	if _, err := dialer(context.Background(), "tcp", "", "192.0.2.1:443"); err != nil {
+		t.Errorf("expected other IPv4 addresses to be dialed, got %v", err)
+	}
+	if _, err := dialer(context.Background(), "tcp", "", "[2001:db8::1]:443"); err != nil {
+		t.Errorf("expected IPv6 phantom to be dialed, got %v", err)
+	}
+	if !slices.Equal(dialed, []string{"192.0.2.1:443", "192.0.2.1:443", "[2001:db8::1]:443"}) {
+		t.Errorf("unexpected dials %v", dialed)
+	}
+}
@@ -0,0 +1,206 @@
+package conjure
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPoolMaxAge is how long a pre-registered phantom connection is
+	// kept before it is considered stale
+	DefaultPoolMaxAge = 2 * time.Minute
+	// MaxPoolSize limits the number of phantom connections kept ready for
+	// each bridge, to spare the station from needless registrations
+	MaxPoolSize = 8
+)
+
+// PhantomPool keeps phantom connections that were registered ahead of time,
+// so that a new connection to a bridge doesn't have to wait for a
+// registration. Connections are pooled separately for each bridge and set of
+// options, with the pool size and maximum age taken from the config. Used
+// connections are replaced in the background, and connections that reach
+// the maximum age are closed without being replaced until the bridge is used
+// again.
+type PhantomPool struct {
+	register func(context.Context, *ConjureConfig) (net.Conn, error)
+
+	lock    sync.Mutex
+	bridges map[string]*bridgePool
+	closed  bool
+}
+
+type bridgePool struct {
+	config  *ConjureConfig
+	conns   []*pooledConn
+	filling int // registrations in progress
+}
+
+type pooledConn struct {
+	net.Conn
+	expiry *time.Timer
+}
+
+// NewPhantomPool returns an empty pool that registers with RegisterContext
+func NewPhantomPool() *PhantomPool {
+	return &PhantomPool{
+		register: RegisterContext,
+		bridges:  make(map[string]*bridgePool),
+	}
+}
+
+// Get returns a phantom connection to the bridge in config. It takes a
+// pooled connection if there is one, and registers a new one otherwise. If
+// config.PoolSize is set, the pool for config is then refilled in the
+// background.
+func (p *PhantomPool) Get(config *ConjureConfig) (net.Conn, error) {
+	return p.GetContext(context.Background(), config)
+}
+
+// GetContext is like Get, but a registration for the connection gives up as
+// soon as ctx is done. Registrations that refill the pool are not affected.
+func (p *PhantomPool) GetContext(ctx context.Context, config *ConjureConfig) (net.Conn, error) {
+	if config.PoolSize <= 0 {
+		return p.register(ctx, config)
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, net.ErrClosed
+	}
+	key := config.poolKey()
+	bridge, ok := p.bridges[key]
+	if !ok {
+		bridge = &bridgePool{config: config.Copy()}
+		// Registrations in the background are not part of the connection
+		// that started them, so they don't report its status
+		bridge.config.OnStatus = nil
+		p.bridges[key] = bridge
+	}
+	var conn net.Conn
+	for conn == nil && len(bridge.conns) > 0 {
+		pooled := bridge.conns[0]
+		bridge.conns = bridge.conns[1:]
+		// A connection whose timer already fired is being closed
+		if pooled.expiry.Stop() {
+			conn = pooled.Conn
+		}
+	}
+	p.fill(bridge)
+	p.lock.Unlock()
+
+	if conn != nil {
+		log.Printf("Using a pre-registered phantom connection")
+		return conn, nil
+	}
+	return p.register(ctx, config)
+}
+
+// fill starts registrations until the pool, counting registrations in
+// progress, is full. p.lock must be held.
+func (p *PhantomPool) fill(bridge *bridgePool) {
+	size := min(bridge.config.PoolSize, MaxPoolSize)
+	for n := len(bridge.conns) + bridge.filling; n < size; n++ {
+		bridge.filling++
+		go func() {
+			conn, err := p.register(context.Background(), bridge.config)
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			bridge.filling--
+			if err != nil {
+				log.Printf("Error pre-registering a phantom: %s", err.Error())
+				return
+			}
+			if p.closed {
+				conn.Close()
+				return
+			}
+			p.add(bridge, conn)
+		}()
+	}
+}
+
+// add puts conn in the pool until it expires. p.lock must be held.
+func (p *PhantomPool) add(bridge *bridgePool, conn net.Conn) {
+	pooled := &pooledConn{Conn: conn}
+	pooled.expiry = time.AfterFunc(bridge.config.PoolMaxAge, func() {
+		p.lock.Lock()
+		for i, c := range bridge.conns {
+			if c == pooled {
+				bridge.conns = append(bridge.conns[:i], bridge.conns[i+1:]...)
+				break
+			}
+		}
+		p.lock.Unlock()
+		conn.Close()
+	})
+	bridge.conns = append(bridge.conns, pooled)
+}
+
+// Close closes the pooled connections. Registrations in progress are closed
+// when they finish.
+func (p *PhantomPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for _, bridge := range p.bridges {
+		for _, pooled := range bridge.conns {
+			if pooled.expiry.Stop() {
+				pooled.Close()
+			}
+		}
+		bridge.conns = nil
+	}
+}
+
+// poolKey identifies the bridge and the options that a pooled connection
+// was registered with. Options that only affect what is done with the
+// connection afterwards, such as retries and the session layer, are left
+// out so that such connections can be shared.
+func (c *ConjureConfig) poolKey() string {
+	var key strings.Builder
+	field := func(name string, value any) {
+		fmt.Fprintf(&key, "%s=%q ", name, fmt.Sprint(value))
+	}
+	field("bridge", c.BridgeAddress)
+	field("registrars", strings.Join(c.Registrars, ","))
+	field("registrar-timeout", c.RegistrarTimeout)
+	field("url", c.RegisterURL)
+	field("fronts", strings.Join(c.Fronts, ","))
+	field("ampcache", c.AMPCacheURL)
+	field("utls-imitate", c.UTLSClientID)
+	field("utls-nosni", c.UTLSRemoveSNI)
+	field("transport", c.Transport)
+	field("stun", c.STUNAddr)
+	proxyURL := ""
+	if c.ProxyURL != nil {
+		proxyURL = c.ProxyURL.String()
+	}
+	field("proxy", proxyURL)
+	field("phantoms", c.Phantoms)
+	field("prefixes", c.Prefixes)
+	field("prefix-default-port", c.PrefixDefaultPort)
+	field("dtls-unordered", c.DTLSUnordered)
+	field("dtls-default-port", c.DTLSDefaultPort)
+	field("skip-udp-check", c.SkipUDPCheck)
+	field("decoy-width", c.DecoyWidth)
+	// The pool of a bridge is kept with the size and age of the config
+	// that created it
+	field("pool", c.PoolSize)
+	field("pool-max-age", c.PoolMaxAge)
+	args := make([]string, 0, len(c.Args))
+	for k := range c.Args {
+		args = append(args, k)
+	}
+	sort.Strings(args)
+	for _, k := range args {
+		field("arg:"+k, strings.Join(c.Args[k], ","))
+	}
+	return key.String()
+}
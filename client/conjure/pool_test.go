@@ -0,0 +1,214 @@
+package conjure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubPool returns a pool whose registrations make one end of a pipe,
+// handing the other end to remotes
+func stubPool(t *testing.T, remotes chan<- net.Conn, calls *atomic.Int32) *PhantomPool {
+	p := NewPhantomPool()
+	p.register = func(ctx context.Context, config *ConjureConfig) (net.Conn, error) {
+		calls.Add(1)
+		local, remote := net.Pipe()
+		remotes <- remote
+		return local, nil
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+// waitForPooled waits until n connections are pooled for config
+func waitForPooled(t *testing.T, p *PhantomPool, config *ConjureConfig, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.lock.Lock()
+		var pooled int
+		if bridge, ok := p.bridges[config.poolKey()]; ok {
+			pooled = len(bridge.conns)
+		}
+		p.lock.Unlock()
+		if pooled == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d pooled connections, got %d", n, pooled)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// isClosed reports whether the other end of remote was closed
+func isClosed(remote net.Conn) bool {
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := remote.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestPhantomPoolDisabled(t *testing.T) {
+	var calls atomic.Int32
+	p := stubPool(t, make(chan net.Conn, 10), &calls)
+	config := &ConjureConfig{BridgeAddress: "192.0.2.1:80"}
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 registrations without a pool, got %d", n)
+	}
+}
+
+func TestPhantomPool(t *testing.T) {
+	var calls atomic.Int32
+	p := stubPool(t, make(chan net.Conn, 10), &calls)
+	config := &ConjureConfig{BridgeAddress: "192.0.2.1:80", PoolSize: 2, PoolMaxAge: time.Minute}
+
+	// The first connection has to be registered, and fills the pool
+	if _, err := p.Get(config); err != nil {
+		t.Fatal(err)
+	}
+	waitForPooled(t, p, config, 2)
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 registrations, got %d", n)
+	}
+
+	// Later ones come from the pool, which is refilled
+	if _, err := p.Get(config); err != nil {
+		t.Fatal(err)
+	}
+	waitForPooled(t, p, config, 2)
+	if n := calls.Load(); n != 4 {
+		t.Errorf("expected 4 registrations, got %d", n)
+	}
+
+	// Other bridges and options get their own pool
+	other := config.Copy()
+	other.Transport = "prefix"
+	if _, err := p.Get(other); err != nil {
+		t.Fatal(err)
+	}
+	waitForPooled(t, p, other, 2)
+	waitForPooled(t, p, config, 2)
+
+	// but connections that only report their status elsewhere share one
+	reporting := config.Copy()
+	reporting.OnStatus = func(Status) {}
+	if _, err := p.Get(reporting); err != nil {
+		t.Fatal(err)
+	}
+	waitForPooled(t, p, config, 2)
+	if n := calls.Load(); n != 8 {
+		t.Errorf("expected 8 registrations, got %d", n)
+	}
+}
+
+func TestPhantomPoolMaxAge(t *testing.T) {
+	var calls atomic.Int32
+	remotes := make(chan net.Conn, 10)
+	p := stubPool(t, remotes, &calls)
+	config := &ConjureConfig{BridgeAddress: "192.0.2.1:80", PoolSize: 1, PoolMaxAge: 50 * time.Millisecond}
+
+	if _, err := p.Get(config); err != nil {
+		t.Fatal(err)
+	}
+	<-remotes
+	waitForPooled(t, p, config, 1)
+	// Expired connections are closed and not replaced
+	waitForPooled(t, p, config, 0)
+	if !isClosed(<-remotes) {
+		t.Error("expected the expired connection to be closed")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected 2 registrations, got %d", n)
+	}
+}
+
+func TestPhantomPoolClose(t *testing.T) {
+	var calls atomic.Int32
+	remotes := make(chan net.Conn, 10)
+	p := stubPool(t, remotes, &calls)
+	config := &ConjureConfig{BridgeAddress: "192.0.2.1:80", PoolSize: 1, PoolMaxAge: time.Minute}
+
+	if _, err := p.Get(config); err != nil {
+		t.Fatal(err)
+	}
+	<-remotes
+	waitForPooled(t, p, config, 1)
+	p.Close()
+	if !isClosed(<-remotes) {
+		t.Error("expected the pooled connection to be closed")
+	}
+	if _, err := p.Get(config); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected a closed pool to fail, got %v", err)
+	}
+}
+
+func TestValidatePool(t *testing.T) {
+	for _, test := range []struct {
+		size   int
+		maxAge time.Duration
+		valid  bool
+	}{
+		{0, 0, true},
+		{2, time.Minute, true},
+		{-1, time.Minute, false},
+		{MaxPoolSize + 1, time.Minute, false},
+		{2, 0, false},
+	} {
+		config := &ConjureConfig{
+			Registrars:  []string{"bdapi"},
+			RegisterURL: "https://registration.example",
+			PoolSize:    test.size,
+			PoolMaxAge:  test.maxAge,
+		}
+		if err := config.Validate(); (err == nil) != test.valid {
+			t.Errorf("pool size %d, max age %v: expected valid %v, got %v", test.size, test.maxAge, test.valid, err)
+		}
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	base := &ConjureConfig{
+		BridgeAddress: "192.0.2.1:80",
+		Registrars:    []string{"bdapi"},
+		Args:          map[string][]string{"a": {"1"}, "b": {"2"}, "c": {"3"}},
+	}
+	key := base.poolKey()
+	for i := 0; i < 10; i++ {
+		if base.Copy().poolKey() != key {
+			t.Fatal("expected the key not to depend on the order of the args")
+		}
+	}
+
+	same := base.Copy()
+	same.Session = true
+	same.RetryBudget = time.Minute
+	same.OnStatus = func(Status) {}
+	if same.poolKey() != key {
+		t.Error("expected options that don't affect registration to share the pool")
+	}
+	for name, change := range map[string]func(*ConjureConfig){
+		"bridge":     func(c *ConjureConfig) { c.BridgeAddress = "192.0.2.2:80" },
+		"registrars": func(c *ConjureConfig) { c.Registrars = []string{"dns"} },
+		"transport":  func(c *ConjureConfig) { c.Transport = "prefix" },
+		"phantoms":   func(c *ConjureConfig) { c.Phantoms = "v6" },
+		"prefixes":   func(c *ConjureConfig) { c.Prefixes = []PrefixWeight{{ID: 1, Weight: 1}} },
+		"proxy":      func(c *ConjureConfig) { c.ProxyURL, _ = url.Parse("socks5://127.0.0.1:1080") },
+		"args":       func(c *ConjureConfig) { c.Args["a"] = []string{"4"} },
+	} {
+		config := base.Copy()
+		change(config)
+		if config.poolKey() == key {
+			t.Errorf("%s: expected a different pool", name)
+		}
+	}
+}
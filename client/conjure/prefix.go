@@ -0,0 +1,108 @@
+package conjure
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/refraction-networking/conjure/pkg/transports/wrapping/prefix"
+	pb "github.com/refraction-networking/conjure/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// RandomPrefix lets the prefix transport pick any prefix it knows
+const RandomPrefix = int32(prefix.Rand)
+
+// PrefixWeight is a prefix that the prefix transport may connect with, and
+// how often to pick it relative to the others
+type PrefixWeight struct {
+	ID     int32
+	Weight int
+}
+
+// ParsePrefixes parses a comma-separated list of prefix IDs, each
+// optionally followed by a colon and a weight, as in "5:3,1". A prefix
+// without a weight has a weight of 1.
+func ParsePrefixes(list string) ([]PrefixWeight, error) {
+	var prefixes []PrefixWeight
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		idStr, weightStr, hasWeight := strings.Cut(item, ":")
+		id, err := strconv.ParseInt(idStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix ID %q", idStr)
+		}
+		p := PrefixWeight{ID: int32(id), Weight: 1}
+		if hasWeight {
+			if p.Weight, err = strconv.Atoi(weightStr); err != nil {
+				return nil, fmt.Errorf("invalid weight %q for prefix %d", weightStr, id)
+			}
+		}
+		if err := p.check(); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("no prefix ID given")
+	}
+	return prefixes, nil
+}
+
+// check reports whether the prefix transport knows the prefix
+func (p PrefixWeight) check() error {
+	if p.Weight <= 0 {
+		return fmt.Errorf("invalid weight %d for prefix %d, must be positive", p.Weight, p.ID)
+	}
+	if p.ID == RandomPrefix {
+		return nil
+	}
+	if _, ok := prefix.DefaultPrefixes[prefix.PrefixID(p.ID)]; !ok {
+		return fmt.Errorf("unknown prefix ID %d", p.ID)
+	}
+	return nil
+}
+
+// pickPrefix picks one of prefixes in proportion to their weights, or any
+// prefix if there are none
+func pickPrefix(prefixes []PrefixWeight) int32 {
+	total := 0
+	for _, p := range prefixes {
+		total += p.Weight
+	}
+	if total <= 0 {
+		return RandomPrefix
+	}
+	n := rand.Intn(total)
+	for _, p := range prefixes {
+		if n < p.Weight {
+			return p.ID
+		}
+		n -= p.Weight
+	}
+	return RandomPrefix
+}
+
+// prefixParams returns the parameters to register the prefix transport with
+func (c *ConjureConfig) prefixParams() *pb.PrefixTransportParams {
+	return &pb.PrefixTransportParams{
+		PrefixId:         proto.Int32(pickPrefix(c.Prefixes)),
+		RandomizeDstPort: proto.Bool(!c.PrefixDefaultPort),
+	}
+}
+
+// connectedPrefix returns the ID and name of the prefix that a prefix
+// transport connected with, which the station may have chosen in place of
+// the one registered
+func connectedPrefix(transport any) (string, string) {
+	t, ok := transport.(*prefix.ClientTransport)
+	if !ok || t.Prefix == nil {
+		return "", ""
+	}
+	id := t.Prefix.ID()
+	return strconv.Itoa(int(id)), id.Name()
+}
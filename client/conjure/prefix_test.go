@@ -0,0 +1,84 @@
+package conjure
+
+import (
+	"slices"
+	"testing"
+
+	transports "github.com/refraction-networking/conjure/pkg/transports/client"
+	"github.com/refraction-networking/conjure/pkg/transports/wrapping/prefix"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected []PrefixWeight
+	}{
+		{"5", []PrefixWeight{{5, 1}}},
+		{"-1", []PrefixWeight{{RandomPrefix, 1}}},
+		{"5:3, 1", []PrefixWeight{{5, 3}, {1, 1}}},
+		{"0:2,9:1,", []PrefixWeight{{0, 2}, {9, 1}}},
+	} {
+		prefixes, err := ParsePrefixes(test.list)
+		if err != nil {
+			t.Errorf("%q: %v", test.list, err)
+			continue
+		}
+		if !slices.Equal(prefixes, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.list, test.expected, prefixes)
+		}
+	}
+
+	for _, list := range []string{"", "tls", "5:", "5:0", "5:-1", "1000", "-2"} {
+		if _, err := ParsePrefixes(list); err == nil {
+			t.Errorf("expected %q to be rejected", list)
+		}
+	}
+}
+
+func TestPickPrefix(t *testing.T) {
+	if id := pickPrefix(nil); id != RandomPrefix {
+		t.Errorf("expected a random prefix without a choice, got %d", id)
+	}
+	if id := pickPrefix([]PrefixWeight{{5, 1}}); id != 5 {
+		t.Errorf("expected the pinned prefix, got %d", id)
+	}
+
+	picked := make(map[int32]int)
+	for i := 0; i < 1000; i++ {
+		picked[pickPrefix([]PrefixWeight{{1, 1}, {4, 9}})]++
+	}
+	if len(picked) != 2 || picked[1] == 0 || picked[4] <= picked[1] {
+		t.Errorf("expected prefix 4 to be picked more often than prefix 1, got %v", picked)
+	}
+}
+
+func TestPrefixParams(t *testing.T) {
+	params := (&ConjureConfig{}).prefixParams()
+	if params.GetPrefixId() != RandomPrefix || !params.GetRandomizeDstPort() {
+		t.Errorf("expected a random prefix on a random port by default, got %v", params)
+	}
+	params = (&ConjureConfig{Prefixes: []PrefixWeight{{3, 1}}, PrefixDefaultPort: true}).prefixParams()
+	if params.GetPrefixId() != 3 || params.GetRandomizeDstPort() {
+		t.Errorf("expected prefix 3 on its usual port, got %v", params)
+	}
+}
+
+func TestConnectedPrefix(t *testing.T) {
+	config := &ConjureConfig{Prefixes: []PrefixWeight{{int32(prefix.TLSClientHello), 1}}}
+	transport, err := transports.NewWithParams("prefix", config.prefixParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, name := connectedPrefix(transport)
+	if id != "4" || name != "TLSClientHello" {
+		t.Errorf("expected prefix 4 (TLSClientHello), got %s (%s)", id, name)
+	}
+
+	transport, err = transports.NewWithParams("min", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := connectedPrefix(transport); id != "" {
+		t.Errorf("expected no prefix for the min transport, got %s", id)
+	}
+}
@@ -0,0 +1,214 @@
+package conjure
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// NewProxyDialer returns a dialer that makes TCP connections through the
+// upstream proxy at proxyURL. The supported schemes are the ones allowed in
+// TOR_PT_PROXY: socks5, socks4a and http (HTTP CONNECT). The socks4a and http
+// dialers are built here rather than registered with golang.org/x/net/proxy,
+// so that programs using this package keep their own proxy registry.
+func NewProxyDialer(proxyURL *url.URL) (proxy.ContextDialer, error) {
+	switch proxyURL.Scheme {
+	case "socks4a":
+		return &socks4aDialer{addr: proxyURL.Host, user: proxyURL.User, forward: proxy.Direct}, nil
+	case "http":
+		return &httpConnectDialer{addr: proxyURL.Host, user: proxyURL.User, forward: proxy.Direct}, nil
+	case "socks5":
+		dialer, err := proxy.FromURL(proxyURL, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("%s dialer does not support contexts", proxyURL.Scheme)
+		}
+		return contextDialer, nil
+	}
+	return nil, fmt.Errorf("proxy scheme %q is not supported", proxyURL.Scheme)
+}
+
+// proxyDialerWithLaddr adapts a proxy dialer to the dialer signature used by
+// tapdance. Only TCP connections without a local address can be proxied.
+func proxyDialerWithLaddr(dialer proxy.ContextDialer) func(context.Context, string, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, laddr, raddr string) (net.Conn, error) {
+		if network != "tcp" && network != "tcp4" && network != "tcp6" {
+			return nil, fmt.Errorf("network %s cannot be used through a proxy", network)
+		}
+		if laddr != "" {
+			return nil, errors.New("local address cannot be set through a proxy")
+		}
+		return dialer.DialContext(ctx, network, raddr)
+	}
+}
+
+// dialProxy connects to the proxy server itself, and makes sure the
+// connection is closed if ctx is done before the proxy handshake completes.
+func dialProxy(ctx context.Context, forward proxy.Dialer, addr string) (net.Conn, func() error, error) {
+	var conn net.Conn
+	var err error
+	if d, ok := forward.(proxy.ContextDialer); ok {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = forward.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan struct{})
+	closed := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+	finish := func() error {
+		close(done)
+		if <-closed {
+			return ctx.Err()
+		}
+		return nil
+	}
+	return conn, finish, nil
+}
+
+// socks4aDialer makes connections through a SOCKS4a proxy
+type socks4aDialer struct {
+	addr    string
+	user    *url.Userinfo
+	forward proxy.Dialer
+}
+
+func (d *socks4aDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *socks4aDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("network %s cannot be used through a socks4a proxy", network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return nil, fmt.Errorf("IPv6 address %s cannot be reached through a socks4a proxy", host)
+	}
+
+	conn, finish, err := dialProxy(ctx, d.forward, d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// VN, CD, DSTPORT, DSTIP, USERID, NULL. An IPv4 destination is sent
+	// directly, everything else is resolved by the proxy (SOCKS4a).
+	req := []byte{0x04, 0x01, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		req = append(req, 0, 0, 0, 1)
+	} else {
+		req = append(req, ip...)
+	}
+	if d.user != nil {
+		req = append(req, []byte(d.user.Username())...)
+	}
+	req = append(req, 0)
+	if ip == nil {
+		req = append(req, []byte(host)...)
+		req = append(req, 0)
+	}
+
+	resp := make([]byte, 8)
+	if _, err = conn.Write(req); err == nil {
+		_, err = io.ReadFull(conn, resp)
+	}
+	if ctxErr := finish(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks4a proxy handshake: %w", err)
+	}
+	if resp[1] != 0x5a {
+		conn.Close()
+		return nil, fmt.Errorf("socks4a proxy rejected the request with code %#x", resp[1])
+	}
+	return conn, nil
+}
+
+// httpConnectDialer makes connections through an HTTP proxy with the
+// CONNECT method
+type httpConnectDialer struct {
+	addr    string
+	user    *url.Userinfo
+	forward proxy.Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("network %s cannot be used through an http proxy", network)
+	}
+	conn, finish, err := dialProxy(ctx, d.forward, d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	var resp *http.Response
+	br := bufio.NewReader(conn)
+	if err = req.Write(conn); err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+	if ctxErr := finish(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy handshake: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy returned status %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("http proxy sent data before the tunnel was established")
+	}
+	return conn, nil
+}
@@ -0,0 +1,284 @@
+package conjure
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// fakeProxy listens on loopback and runs handle for each connection it
+// accepts. It returns the proxy URL with the given scheme.
+func fakeProxy(t *testing.T, scheme string, user *url.Userinfo, handle func(net.Conn)) *url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: scheme, Host: ln.Addr().String(), User: user}
+}
+
+// checkEcho makes sure conn is connected to a server that echoes data
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	msg := []byte("hello")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("expected %q, got %q", msg, buf)
+	}
+}
+
+// socks4aServer reads a SOCKS4a request, reports it on requests and replies
+// with code.
+func socks4aServer(code byte, requests chan<- []byte) func(net.Conn) {
+	return func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req := make([]byte, 8)
+		if _, err := io.ReadFull(br, req); err != nil {
+			return
+		}
+		user, err := br.ReadBytes(0)
+		if err != nil {
+			return
+		}
+		req = append(req, user...)
+		if bytes.Equal(req[4:8], []byte{0, 0, 0, 1}) {
+			host, err := br.ReadBytes(0)
+			if err != nil {
+				return
+			}
+			req = append(req, host...)
+		}
+		requests <- req
+		if _, err := conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0}); err != nil {
+			return
+		}
+		if code == 0x5a {
+			io.Copy(conn, br)
+		}
+	}
+}
+
+func TestSocks4aDialer(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		addr    string
+		user    *url.Userinfo
+		code    byte
+		request []byte
+	}{
+		{
+			name:    "ipv4",
+			addr:    "192.0.2.1:443",
+			code:    0x5a,
+			request: []byte{4, 1, 1, 187, 192, 0, 2, 1, 0},
+		},
+		{
+			name:    "hostname with user",
+			addr:    "bridge.example:80",
+			user:    url.User("tor"),
+			code:    0x5a,
+			request: append([]byte{4, 1, 0, 80, 0, 0, 0, 1, 't', 'o', 'r', 0}, "bridge.example\x00"...),
+		},
+		{
+			name:    "rejected",
+			addr:    "192.0.2.1:443",
+			code:    0x5b,
+			request: []byte{4, 1, 1, 187, 192, 0, 2, 1, 0},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			requests := make(chan []byte, 1)
+			proxyURL := fakeProxy(t, "socks4a", test.user, socks4aServer(test.code, requests))
+			dialer, err := NewProxyDialer(proxyURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialer.DialContext(context.Background(), "tcp", test.addr)
+			if req := <-requests; !bytes.Equal(req, test.request) {
+				t.Errorf("expected request %v, got %v", test.request, req)
+			}
+			if test.code != 0x5a {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected rejected request to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			checkEcho(t, conn)
+		})
+	}
+}
+
+func TestSocks4aDialerIPv6(t *testing.T) {
+	dialer := &socks4aDialer{addr: "127.0.0.1:1", forward: &net.Dialer{}}
+	if _, err := dialer.DialContext(context.Background(), "tcp", "[2001:db8::1]:443"); err == nil {
+		t.Error("expected IPv6 destination to be rejected")
+	}
+	if _, err := dialer.DialContext(context.Background(), "udp", "192.0.2.1:443"); err == nil {
+		t.Error("expected udp to be rejected")
+	}
+}
+
+// httpConnectServer reads a CONNECT request, reports it on requests and
+// replies with status.
+func httpConnectServer(status int, requests chan<- *http.Request) func(net.Conn) {
+	return func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		requests <- req
+		resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+		if status == http.StatusOK {
+			io.Copy(conn, br)
+		}
+	}
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		user   *url.Userinfo
+		status int
+		auth   string
+	}{
+		{
+			name:   "success",
+			status: http.StatusOK,
+		},
+		{
+			name:   "auth",
+			user:   url.UserPassword("tor", "secret"),
+			status: http.StatusOK,
+			auth:   "Basic " + base64.StdEncoding.EncodeToString([]byte("tor:secret")),
+		},
+		{
+			name:   "proxy authentication required",
+			status: http.StatusProxyAuthRequired,
+		},
+		{
+			name:   "forbidden",
+			status: http.StatusForbidden,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			requests := make(chan *http.Request, 1)
+			proxyURL := fakeProxy(t, "http", test.user, httpConnectServer(test.status, requests))
+			dialer, err := NewProxyDialer(proxyURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialer.DialContext(context.Background(), "tcp", "bridge.example:443")
+			req := <-requests
+			if req.Method != http.MethodConnect || req.Host != "bridge.example:443" {
+				t.Errorf("unexpected request %s %s", req.Method, req.Host)
+			}
+			if auth := req.Header.Get("Proxy-Authorization"); auth != test.auth {
+				t.Errorf("expected Proxy-Authorization %q, got %q", test.auth, auth)
+			}
+			if test.status != http.StatusOK {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected non-200 response to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			checkEcho(t, conn)
+		})
+	}
+}
+
+func TestProxyDialerCancel(t *testing.T) {
+	for _, scheme := range []string{"socks4a", "http"} {
+		t.Run(scheme, func(t *testing.T) {
+			// A proxy that accepts connections but never answers
+			proxyURL := fakeProxy(t, scheme, nil, func(conn net.Conn) {
+				io.Copy(io.Discard, conn)
+			})
+			dialer, err := NewProxyDialer(proxyURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			errChan := make(chan error, 1)
+			go func() {
+				_, err := dialer.DialContext(ctx, "tcp", "192.0.2.1:443")
+				errChan <- err
+			}()
+			select {
+			case err := <-errChan:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("expected context.Canceled, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("dial was not cancelled")
+			}
+		})
+	}
+}
+
+// Programs that import the package keep their own golang.org/x/net/proxy
+// registry, so the uTLS round tripper, which only takes a proxy URL, can
+// only be used through SOCKS5 proxies.
+func TestProxyDialerNotRegistered(t *testing.T) {
+	for _, scheme := range []string{"socks4a", "http"} {
+		proxyURL := &url.URL{Scheme: scheme, Host: "127.0.0.1:8080"}
+		if _, err := NewProxyDialer(proxyURL); err != nil {
+			t.Errorf("%s: %v", scheme, err)
+		}
+		if _, err := proxy.FromURL(proxyURL, proxy.Direct); err == nil {
+			t.Errorf("expected %s to be left out of the proxy registry", scheme)
+		}
+
+		config := &ConjureConfig{Registrars: []string{"bdapi"}, UTLSClientID: "hellochrome_auto", ProxyURL: proxyURL}
+		if err := config.ValidateProxy(); err == nil {
+			t.Errorf("expected utls-imitate to be rejected through a %s proxy", scheme)
+		}
+	}
+	config := &ConjureConfig{Registrars: []string{"bdapi"}, UTLSClientID: "hellochrome_auto", ProxyURL: &url.URL{Scheme: "socks5", Host: "127.0.0.1:9050"}}
+	if err := config.ValidateProxy(); err != nil {
+		t.Errorf("expected utls-imitate to work through a socks5 proxy, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package conjure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportAuto races all of the AutoTransports
+const TransportAuto = "auto"
+
+// AutoTransports are the transports raced by TransportAuto, in order of
+// preference
+var AutoTransports = []string{"min", "prefix", "dtls"}
+
+// transportStagger is how long each transport in a race gets before the
+// next one is started
+var transportStagger = 5 * time.Second
+
+// preferredTransports remembers, for each bridge and list of transports,
+// the transport that last carried data from the bridge, and the transport
+// whose connection last went stale. Later races for the same bridge start
+// with the preferred transport, and try the stale one last.
+var preferredTransports = struct {
+	sync.Mutex
+	m     map[string]string
+	stale map[string]string
+}{m: make(map[string]string), stale: make(map[string]string)}
+
+// transportConn is the winner of a race. Once data from the bridge arrives
+// over it, which is what the staleness check waits for, its transport
+// becomes the preferred one.
+type transportConn struct {
+	net.Conn
+	key  string
+	name string
+	once sync.Once
+}
+
+func (c *transportConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() {
+			preferredTransports.Lock()
+			preferredTransports.m[c.key] = c.name
+			if preferredTransports.stale[c.key] == c.name {
+				delete(preferredTransports.stale, c.key)
+			}
+			preferredTransports.Unlock()
+		})
+	}
+	return n, err
+}
+
+// MarkStale reports that conn, returned by Register or a Dialer, connected
+// but never carried data from the bridge. If conn won a race between
+// transports, its transport loses its preference and is tried last in the
+// next races for the same bridge, so that a transport that connects but
+// goes stale doesn't keep winning.
+func MarkStale(conn net.Conn) {
+	c, ok := conn.(*transportConn)
+	if !ok {
+		return
+	}
+	preferredTransports.Lock()
+	defer preferredTransports.Unlock()
+	if preferredTransports.m[c.key] == c.name {
+		delete(preferredTransports.m, c.key)
+	}
+	preferredTransports.stale[c.key] = c.name
+}
+
+// raceTransports dials the bridge with each of the named transports,
+// starting the preferred one first and each of the others transportStagger
+// later, or as soon as the previous one fails. The first connection that is
+// made is returned, and the other attempts are canceled.
+func raceTransports(ctx context.Context, bridgeAddress string, names []string, dial func(ctx context.Context, name string) (net.Conn, error)) (net.Conn, error) {
+	key := bridgeAddress + " " + strings.Join(names, ",")
+	preferredTransports.Lock()
+	preferred := preferredTransports.m[key]
+	stale := preferredTransports.stale[key]
+	preferredTransports.Unlock()
+	order := make([]string, 0, len(names))
+	for _, name := range names {
+		if name == preferred {
+			order = append([]string{name}, order...)
+		} else if name != stale {
+			order = append(order, name)
+		}
+	}
+	if slices.Contains(names, stale) && stale != preferred {
+		order = append(order, stale)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		name string
+		conn net.Conn
+		err  error
+	}
+	// Buffered so that attempts that finish after the race never block
+	results := make(chan result, len(order))
+	next, running := 0, 0
+	start := func() {
+		name := order[next]
+		next++
+		running++
+		log.Printf("Trying %s transport", name)
+		go func() {
+			conn, err := dial(ctx, name)
+			results <- result{name, conn, err}
+		}()
+	}
+
+	start()
+	stagger := time.NewTimer(transportStagger)
+	defer stagger.Stop()
+	var errs []error
+	for running > 0 {
+		select {
+		case <-stagger.C:
+			if next < len(order) {
+				start()
+				stagger.Reset(transportStagger)
+			}
+		case r := <-results:
+			running--
+			if r.err != nil {
+				log.Printf("Error connecting with %s transport: %s", r.name, r.err.Error())
+				errs = append(errs, fmt.Errorf("%s: %w", r.name, r.err))
+				if next < len(order) {
+					start()
+					stagger.Reset(transportStagger)
+				}
+				continue
+			}
+			log.Printf("Connected with %s transport", r.name)
+			// Close the connections of attempts that succeed despite
+			// being canceled
+			go func(running int) {
+				for ; running > 0; running-- {
+					if r := <-results; r.err == nil {
+						r.conn.Close()
+					}
+				}
+			}(running)
+			return &transportConn{Conn: r.conn, key: key, name: r.name}, nil
+		}
+	}
+	return nil, errors.Join(errs...)
+}
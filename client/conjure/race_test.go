@@ -0,0 +1,204 @@
+package conjure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubTransports dials by looking up the outcome for each transport:
+// "succeed", "fail" or "block" until canceled. It records the order in
+// which transports were started and whether blocked ones were canceled.
+type stubTransports struct {
+	results map[string]string
+
+	lock     sync.Mutex
+	started  []string
+	canceled []string
+}
+
+func (s *stubTransports) dial(ctx context.Context, name string) (net.Conn, error) {
+	s.lock.Lock()
+	s.started = append(s.started, name)
+	s.lock.Unlock()
+	switch s.results[name] {
+	case "succeed":
+		local, remote := net.Pipe()
+		go func() {
+			remote.Write([]byte("hello"))
+			remote.Close()
+		}()
+		return local, nil
+	case "block":
+		<-ctx.Done()
+		s.lock.Lock()
+		s.canceled = append(s.canceled, name)
+		s.lock.Unlock()
+		return nil, ctx.Err()
+	}
+	return nil, errors.New("dial failed")
+}
+
+func TestRaceTransports(t *testing.T) {
+	transportStagger = 50 * time.Millisecond
+	defer func() { transportStagger = 5 * time.Second }()
+
+	for _, test := range []struct {
+		name     string
+		results  map[string]string
+		winner   string
+		started  []string
+		canceled []string
+	}{
+		{
+			name:    "first succeeds",
+			results: map[string]string{"min": "succeed", "prefix": "succeed"},
+			winner:  "min",
+			started: []string{"min"},
+		},
+		{
+			name:    "next starts on failure",
+			results: map[string]string{"min": "fail", "prefix": "succeed"},
+			winner:  "prefix",
+			started: []string{"min", "prefix"},
+		},
+		{
+			name:     "next starts after stagger",
+			results:  map[string]string{"min": "block", "prefix": "succeed"},
+			winner:   "prefix",
+			started:  []string{"min", "prefix"},
+			canceled: []string{"min"},
+		},
+		{
+			name:    "all fail",
+			results: map[string]string{"min": "fail", "prefix": "fail"},
+			started: []string{"min", "prefix"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &stubTransports{results: test.results}
+			conn, err := raceTransports(context.Background(), t.Name(), []string{"min", "prefix"}, stub.dial)
+			if test.winner == "" {
+				if err == nil {
+					t.Fatal("expected the race to fail")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if name := conn.(*transportConn).name; name != test.winner {
+					t.Errorf("expected %s to win, got %s", test.winner, name)
+				}
+				conn.Close()
+			}
+
+			// Canceled attempts finish in the background
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				stub.lock.Lock()
+				canceled := len(stub.canceled)
+				stub.lock.Unlock()
+				if canceled == len(test.canceled) || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			stub.lock.Lock()
+			defer stub.lock.Unlock()
+			if !slices.Equal(stub.started, test.started) {
+				t.Errorf("expected %v to be started, got %v", test.started, stub.started)
+			}
+			if !slices.Equal(stub.canceled, test.canceled) {
+				t.Errorf("expected %v to be canceled, got %v", test.canceled, stub.canceled)
+			}
+		})
+	}
+}
+
+func TestRaceTransportsPreferred(t *testing.T) {
+	preferredTransports.Lock()
+	clear(preferredTransports.m)
+	clear(preferredTransports.stale)
+	preferredTransports.Unlock()
+	stub := &stubTransports{results: map[string]string{"min": "fail", "prefix": "succeed"}}
+	names := []string{"min", "prefix"}
+
+	conn, err := raceTransports(context.Background(), "192.0.2.1:80", names, stub.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Winning is not enough to become preferred, data has to arrive
+	conn2, err := raceTransports(context.Background(), "192.0.2.1:80", names, stub.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2.Close()
+	if expected := []string{"min", "prefix", "min", "prefix"}; !slices.Equal(stub.started, expected) {
+		t.Errorf("expected %v to be started, got %v", expected, stub.started)
+	}
+	if _, err := conn.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	stub.started = nil
+	conn, err = raceTransports(context.Background(), "192.0.2.1:80", names, stub.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !slices.Equal(stub.started, []string{"prefix"}) {
+		t.Errorf("expected only the preferred transport to be started, got %v", stub.started)
+	}
+
+	// A transport that goes stale loses its preference, and is tried last
+	// even though it connects
+	stub.results = map[string]string{"min": "succeed", "prefix": "succeed"}
+	stub.started = nil
+	conn, err = raceTransports(context.Background(), "192.0.2.1:80", names, stub.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MarkStale(conn)
+	conn.Close()
+	stub.started = nil
+	conn, err = raceTransports(context.Background(), "192.0.2.1:80", names, stub.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !slices.Equal(stub.started, []string{"min"}) {
+		t.Errorf("expected the stale transport not to be started first, got %v", stub.started)
+	}
+	stub.results = map[string]string{"min": "fail", "prefix": "succeed"}
+
+	// Other bridges don't share the preference
+	stub.started = nil
+	conn, err = raceTransports(context.Background(), "192.0.2.2:80", names, stub.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !slices.Equal(stub.started, []string{"min", "prefix"}) {
+		t.Errorf("expected another bridge to start with min, got %v", stub.started)
+	}
+}
+
+func TestTransports(t *testing.T) {
+	for transport, expected := range map[string][]string{
+		"":            {"min"},
+		"prefix":      {"prefix"},
+		"auto":        AutoTransports,
+		"dtls, min,":  {"dtls", "min"},
+		"prefix,dtls": {"prefix", "dtls"},
+	} {
+		config := &ConjureConfig{Transport: transport}
+		if names := config.transports(); !slices.Equal(names, expected) {
+			t.Errorf("%q: expected %v, got %v", transport, expected, names)
+		}
+	}
+}
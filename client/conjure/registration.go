@@ -14,28 +14,16 @@ import (
 	"github.com/refraction-networking/conjure/pkg/client/assets"
 	"github.com/refraction-networking/conjure/pkg/registrars/registration"
 	transports "github.com/refraction-networking/conjure/pkg/transports/client"
-	"github.com/refraction-networking/conjure/proto"
 	pb "github.com/refraction-networking/conjure/proto"
 	"github.com/refraction-networking/gotapdance/tapdance"
 	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
 
 	utlsutil "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/utls"
 
 	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/certs"
 )
 
-type ConjureConfig struct {
-	Registrar     string
-	RegisterURL   string // URL of the conjure bidirectional registration API endpoint
-	Fronts        []string
-	AMPCacheURL   string
-	BridgeAddress string // IP address of the Tor Conjure PT bridge
-	UTLSClientID  string
-	UTLSRemoveSNI bool
-	Transport     string
-	STUNAddr      string
-}
-
 type Rendezvous struct {
 	RegisterURL   string
 	Fronts        []string
@@ -64,33 +52,118 @@ func (r *Rendezvous) RoundTrip(req *http.Request) (*http.Response, error) {
 
 // We make a copy of DefaultTransport because we want the default Dial
 // and TLSHandshakeTimeout settings. But we want to disable the default
-// ProxyFromEnvironment setting.
-func createRegistrationTransport() http.RoundTripper {
+// ProxyFromEnvironment setting. If an upstream proxy dialer is given,
+// all connections are made through it instead.
+func createRegistrationTransport(proxyDialer proxy.ContextDialer) http.RoundTripper {
 	tlsConfig := &tls.Config{
 		RootCAs: certs.GetRootCAs(),
 	}
 	transport := &http.Transport{TLSClientConfig: tlsConfig}
 	transport.Proxy = nil
 	transport.ResponseHeaderTimeout = 15 * time.Second
+	if proxyDialer != nil {
+		transport.DialContext = proxyDialer.DialContext
+	}
 	return transport
 }
 
+// Register registers with the station and connects to the bridge in config
+// through the phantom it assigns. If config lists several transports, they
+// are raced against each other.
 func Register(config *ConjureConfig) (net.Conn, error) {
+	return RegisterContext(context.Background(), config)
+}
+
+// RegisterContext is like Register, but gives up as soon as ctx is done,
+// whether registration or the phantom dial is in progress.
+func RegisterContext(ctx context.Context, config *ConjureConfig) (net.Conn, error) {
+	names := config.transports()
+	if config.ProxyURL != nil {
+		names = filterTransports(names, TransportSpec.proxyOK)
+	}
+	names, err := config.checkUDPTransports(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	return abortable(ctx, func() (net.Conn, error) {
+		if len(names) == 1 {
+			return register(ctx, config, names[0])
+		}
+		dial := func(ctx context.Context, transportName string) (net.Conn, error) {
+			return register(ctx, config, transportName)
+		}
+		return raceTransports(ctx, config.BridgeAddress, names, dial)
+	})
+}
+
+// abortable runs dial, returning as soon as ctx is done rather than waiting
+// for parts of tapdance that are slow to notice. A connection that dial
+// makes after that is closed.
+func abortable(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// Buffered so that a dial that outlives ctx never blocks
+	results := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		results <- result{conn, err}
+	}()
+	select {
+	case r := <-results:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-results; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
 
+// register registers and connects to the bridge with the named transport
+func register(ctx context.Context, config *ConjureConfig, transportName string) (net.Conn, error) {
 	dialer := &tapdance.Dialer{
 		// Use conjure to connect to phantom addresses, not vanilla tapdance
 		DarkDecoy: true,
 		// If true, the station sends PROXY header in the connection from the
 		// station to the conjure bridge that includes the client's IP address
 		UseProxyHeader: true,
-		// For MVP, we don't (yet) support v6 phantoms
-		V6Support: false,
-		// Width is specific to the decoy routing registrat, at the moment we're using
-		// only the bidirectional registrar
+		// The number of decoys to register through is set on the decoy
+		// registrar instead, as the Width of the dialer is deprecated
 		Width: 0,
 	}
 
-	transport := createRegistrationTransport()
+	var proxyDialer proxy.ContextDialer
+	if config.ProxyURL != nil {
+		var err error
+		proxyDialer, err = NewProxyDialer(config.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		// Connect to the phantom through the upstream proxy as well
+		dialer.DialerWithLaddr = proxyDialerWithLaddr(proxyDialer)
+	}
+
+	// Register for IPv6 phantoms if they were asked for and we can reach them.
+	// tapdance then races the IPv4 and IPv6 phantoms, so for IPv6 only we
+	// refuse to dial the IPv4 one once it is known.
+	family := phantomFamily(config)
+	dialer.V6Support = family != PhantomsV4
+	var v4Filter *ipv4PhantomFilter
+	if family == PhantomsV6 {
+		next := dialer.DialerWithLaddr
+		if next == nil {
+			next = defaultDialer
+		}
+		v4Filter = &ipv4PhantomFilter{}
+		dialer.DialerWithLaddr = v4Filter.wrap(next)
+	}
+	log.Printf("Using %s phantoms", family)
+
+	transport := createRegistrationTransport(proxyDialer)
 	if config.UTLSClientID != "" {
 		utlsClienHelloID, err := utlsutil.NameToUTLSID(config.UTLSClientID)
 		if err != nil {
@@ -100,13 +173,10 @@ func Register(config *ConjureConfig) (net.Conn, error) {
 			RootCAs: certs.GetRootCAs(),
 		}
 
-		transport = utlsutil.NewUTLSHTTPRoundTripperWithProxy(utlsClienHelloID, utlsConfig, transport, config.UTLSRemoveSNI, nil)
+		transport = utlsutil.NewUTLSHTTPRoundTripperWithProxy(utlsClienHelloID, utlsConfig, transport, config.UTLSRemoveSNI, config.ProxyURL)
 
 	}
 
-	var registrar tapdance.Registrar
-	var err error
-
 	// APIRegistrarBidirectional expects an HTTP client for sending the registration request.
 	// The http.RoundTripper associated with this client dictates the censorship-resistant
 	// rendezvous method used to establish a connection with the registration server.
@@ -122,98 +192,24 @@ func Register(config *ConjureConfig) (net.Conn, error) {
 		},
 	}
 
-	// The registration step connects a client with a phantom IP address.
-	// There are currently three options for registration:
-	//   1) APIRegistrarBidirectional: this is a bidirectional registration process that allows
-	//        a client to submit a REST API request over HTTP for the phantom IP
-	//   2) AMPCacheRegistrarBidirectional: this is a bidirectional registration process that
-	//       allows a client to use AMPCache as a proxy to submit a request to the registration
-	//       server for the phantom IP
-	//   3) DecoyRegistrar: this is a unidirectional registration process used by the
-	//        original TapDance protocol in which the client essentially tells the refraction
-	//        station which phantom IP to use
-	// For simplicity, we implement support for the bidirectional
-	// registration and ampcache registration processes. Different censorship resistant
-	// transport methods can be used to tunnel the HTTP requests, such as domain fronting
-	regConfig := &registration.Config{
-		Bidirectional: true,
-		HTTPClient:    client,
-		STUNAddr:      config.STUNAddr,
-	}
-	switch config.Registrar {
-	case "ampcache":
-		if config.AMPCacheURL == "" {
-			log.Println("AMP Cache registrar selected with no AMP cache URL")
-			return nil, err
-		}
-		regConfig.Target = config.RegisterURL + "/amp/register-bidirectional" //Note: this goes in the HTTP request
-		regConfig.AMPCacheURL = config.AMPCacheURL
-		regConfig.MaxRetries = 0
-		regConfig.HTTPClient = client
-		log.Println("Register through AMP cache at:", regConfig.Target)
-		registrar, err = registration.NewAMPCacheRegistrar(regConfig)
-	case "dns":
-		dnsConf := assets.Assets().GetDNSRegConf()
-		pubkey := dnsConf.Pubkey
-		if pubkey == nil {
-			pubkey = assets.Assets().GetConjurePubkey()[:]
-		}
-		regConfig.Pubkey = dnsConf.Pubkey
-		var method registration.DNSTransportMethodType
-		switch *dnsConf.DnsRegMethod {
-		case pb.DnsRegMethod_UDP:
-			method = registration.UDP
-		case pb.DnsRegMethod_DOT:
-			regConfig.UTLSDistribution = *dnsConf.UtlsDistribution
-			method = registration.DoT
-		case pb.DnsRegMethod_DOH:
-			regConfig.UTLSDistribution = *dnsConf.UtlsDistribution
-			method = registration.DoH
-		default:
-			return nil, errors.New("unknown reg method in conf")
-		}
-		regConfig.DNSTransportMethod = method
-		regConfig.Target = *dnsConf.Target
-		regConfig.BaseDomain = *dnsConf.Domain
-		regConfig.Pubkey = pubkey
-		regConfig.MaxRetries = 3
-		regConfig.STUNAddr = *dnsConf.StunServer
-		log.Println("Register through DNS at:", regConfig.Target)
-		registrar, err = registration.NewDNSRegistrar(regConfig)
-	case "bdapi":
-		fallthrough
-	default:
-		log.Println("Register through API with:", regConfig.Target)
-		regConfig.Target = config.RegisterURL + "/api/register-bidirectional" //Note: this goes in the HTTP request
-		regConfig.MaxRetries = 0
-		regConfig.HTTPClient = client
-		registrar, err = registration.NewAPIRegistrar(regConfig)
-	}
+	registrar, err := newFallbackRegistrar(config, client)
 	if err != nil {
 		return nil, err
 	}
+	registrar.v4Filter = v4Filter
 	dialer.DarkDecoyRegistrar = registrar
 
-	// There are currently three available transports:
-	//   1) min
-	//   2) prefix
-	//   3) dtls
-	var params any
-	switch config.Transport {
-	case "dtls":
-		randomize := true
-		unordered := false
-		params = &proto.DTLSTransportParams{RandomizeDstPort: &randomize, Unordered: &unordered}
-	case "prefix":
-		randomize := true
-		id := int32(-1)
-		params = &proto.PrefixTransportParams{RandomizeDstPort: &randomize, PrefixId: &id}
-	default:
-		params = &proto.GenericTransportParams{}
-		config.Transport = "min"
+	// The built-in transports are min, prefix and dtls, and others can be
+	// added with RegisterTransport
+	spec, ok := lookupTransport(transportName)
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", transportName)
 	}
-
-	dialer.TransportConfig, err = transports.NewWithParams(config.Transport, params)
+	params, err := spec.Params(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer.TransportConfig, err = transports.NewWithParams(transportName, params)
 	if err != nil {
 		return nil, err
 	}
@@ -221,12 +217,128 @@ func Register(config *ConjureConfig) (net.Conn, error) {
 	// Make a connection to the bridge through the phantom
 	// This will register the client, obtaining a phantom address and connect
 	// to that phantom address all in one go
-	phantomConn, err := dialer.DialContext(context.Background(), "tcp", config.BridgeAddress)
+	config.ReportStatus(Status{Phase: PhaseRegistering, Transport: transportName})
+	// The station may send a newer ClientConf even if the phantom can't be
+	// reached
+	defer checkClientConf()
+	phantomConn, err := dialer.DialContext(ctx, "tcp", config.BridgeAddress)
 	if err != nil {
+		config.ReportStatus(Status{Phase: PhaseFailed, Transport: transportName, Err: err})
 		return nil, err
 	}
 
 	log.Println("Successfully connected to phantom proxy!")
+	prefixID, prefixName := connectedPrefix(dialer.TransportConfig)
+	if prefixID != "" {
+		log.Printf("Connected with prefix %s (%s)", prefixID, prefixName)
+	}
+	config.ReportStatus(Status{Phase: PhaseConnected, Transport: transportName, Prefix: prefixID, Phantom: phantomConn.RemoteAddr().String()})
 
 	return phantomConn, nil
 }
+
+// newRegistrar creates the registrar with the given name, from those added
+// with RegisterRegistrar and the built-in ones.
+//
+// The registration step connects a client with a phantom IP address.
+// There are currently four built-in options for registration:
+//  1. APIRegistrarBidirectional: this is a bidirectional registration process that allows
+//     a client to submit a REST API request over HTTP for the phantom IP
+//  2. AMPCacheRegistrarBidirectional: this is a bidirectional registration process that
+//     allows a client to use AMPCache as a proxy to submit a request to the registration
+//     server for the phantom IP
+//  3. DNSRegistrar: this is a bidirectional registration process that sends the
+//     registration in DNS queries, with the settings in the ClientConf
+//  4. DecoyRegistrar: this is a unidirectional registration process used by the
+//     original TapDance protocol in which the client essentially tells the refraction
+//     station which phantom IP to use. The registration is hidden in TLS connections
+//     to decoys picked from the decoy list in the ClientConf, so there is no
+//     registration endpoint to block.
+//
+// Different censorship resistant transport methods can be used to tunnel the
+// HTTP requests of the bidirectional registrars, such as domain fronting
+func newRegistrar(name string, config *ConjureConfig, client *http.Client) (tapdance.Registrar, error) {
+	spec, ok := lookupRegistrar(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown registrar %q", name)
+	}
+	if config.ProxyURL != nil {
+		if err := proxyRegistrarError(name); err != nil {
+			return nil, err
+		}
+	}
+	return spec.New(config, client)
+}
+
+// newRegConfig returns the settings that the bidirectional registrars share
+func newRegConfig(config *ConjureConfig, client *http.Client) *registration.Config {
+	regConfig := &registration.Config{
+		Bidirectional: true,
+		HTTPClient:    client,
+		STUNAddr:      config.STUNAddr,
+	}
+	if config.ProxyURL != nil {
+		// STUN runs over UDP outside of the proxy, and would reveal our
+		// own address rather than the one the station sees. The API
+		// registrar skips the lookup when no STUN server is set.
+		regConfig.STUNAddr = ""
+	}
+	return regConfig
+}
+
+func newAPIRegistrar(config *ConjureConfig, client *http.Client) (tapdance.Registrar, error) {
+	regConfig := newRegConfig(config, client)
+	regConfig.Target = config.RegisterURL + "/api/register-bidirectional" //Note: this goes in the HTTP request
+	log.Println("Register through API with:", regConfig.Target)
+	regConfig.MaxRetries = 0
+	return registration.NewAPIRegistrar(regConfig)
+}
+
+func newAMPCacheRegistrar(config *ConjureConfig, client *http.Client) (tapdance.Registrar, error) {
+	regConfig := newRegConfig(config, client)
+	regConfig.Target = config.RegisterURL + "/amp/register-bidirectional" //Note: this goes in the HTTP request
+	regConfig.AMPCacheURL = config.AMPCacheURL
+	regConfig.MaxRetries = 0
+	log.Println("Register through AMP cache at:", regConfig.Target)
+	return registration.NewAMPCacheRegistrar(regConfig)
+}
+
+func newDNSRegistrar(config *ConjureConfig, client *http.Client) (tapdance.Registrar, error) {
+	regConfig := newRegConfig(config, client)
+	dnsConf := assets.Assets().GetDNSRegConf()
+	pubkey := dnsConf.Pubkey
+	if pubkey == nil {
+		pubkey = assets.Assets().GetConjurePubkey()[:]
+	}
+	var method registration.DNSTransportMethodType
+	switch *dnsConf.DnsRegMethod {
+	case pb.DnsRegMethod_UDP:
+		method = registration.UDP
+	case pb.DnsRegMethod_DOT:
+		regConfig.UTLSDistribution = *dnsConf.UtlsDistribution
+		method = registration.DoT
+	case pb.DnsRegMethod_DOH:
+		regConfig.UTLSDistribution = *dnsConf.UtlsDistribution
+		method = registration.DoH
+	default:
+		return nil, errors.New("unknown reg method in conf")
+	}
+	regConfig.DNSTransportMethod = method
+	regConfig.Target = *dnsConf.Target
+	regConfig.BaseDomain = *dnsConf.Domain
+	regConfig.Pubkey = pubkey
+	regConfig.MaxRetries = 3
+	regConfig.STUNAddr = *dnsConf.StunServer
+	log.Println("Register through DNS at:", regConfig.Target)
+	return registration.NewDNSRegistrar(regConfig)
+}
+
+func newDecoyRegistrar(config *ConjureConfig, client *http.Client) (tapdance.Registrar, error) {
+	registrar := registration.NewDecoyRegistrar()
+	registrar.Width = DefaultDecoyWidth
+	if config.DecoyWidth > 0 {
+		registrar.Width = uint(config.DecoyWidth)
+	}
+	log.Printf("Register through %d decoys", registrar.Width)
+	return registrar, nil
+}
@@ -0,0 +1,30 @@
+package conjure
+
+import (
+	"net/http"
+	"testing"
+
+	dr "github.com/refraction-networking/conjure/pkg/registrars/decoy-registrar"
+)
+
+func TestNewDecoyRegistrar(t *testing.T) {
+	for _, test := range []struct {
+		width    int
+		expected uint
+	}{
+		{0, DefaultDecoyWidth},
+		{2, 2},
+	} {
+		registrar, err := newRegistrar("decoy", &ConjureConfig{DecoyWidth: test.width}, &http.Client{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoy, ok := registrar.(*dr.DecoyRegistrar)
+		if !ok {
+			t.Fatalf("expected a decoy registrar, got %T", registrar)
+		}
+		if decoy.Width != test.expected {
+			t.Errorf("expected width %d for decoy-width %d, got %d", test.expected, test.width, decoy.Width)
+		}
+	}
+}
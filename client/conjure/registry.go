@@ -0,0 +1,210 @@
+package conjure
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/refraction-networking/conjure/proto"
+	"github.com/refraction-networking/gotapdance/tapdance"
+)
+
+// RegistrarFactory creates a registrar for a connection. The bridge line
+// arguments of the connection are in config.Args, including any that the
+// client doesn't know. client sends HTTP requests through the fronts, uTLS
+// fingerprint and upstream proxy of the config.
+type RegistrarFactory func(config *ConjureConfig, client *http.Client) (tapdance.Registrar, error)
+
+// TransportParamsBuilder returns the parameters to register a transport
+// with, for a connection with config. The bridge line arguments of the
+// connection are in config.Args.
+type TransportParamsBuilder func(config *ConjureConfig) (any, error)
+
+// RegistrarSpec describes a registrar and what it needs from a connection
+type RegistrarSpec struct {
+	New RegistrarFactory
+	// Validate, if set, reports whether the registrar can be used with
+	// config, for example because an option it needs is missing
+	Validate func(config *ConjureConfig) error
+	// NeedsUDP is set for registrars that send UDP, which can't be sent
+	// through an upstream proxy
+	NeedsUDP bool
+	// DirectOnly is set for registrars that can't be used through an
+	// upstream proxy for other reasons
+	DirectOnly bool
+}
+
+// TransportSpec describes a transport and what it needs from a connection
+type TransportSpec struct {
+	Params TransportParamsBuilder
+	// NeedsUDP is set for transports that connect to the phantom over UDP,
+	// which can't be sent through an upstream proxy, and which are tried
+	// last on networks that seem to block UDP
+	NeedsUDP bool
+	// DirectOnly is set for transports that can't be used through an
+	// upstream proxy for other reasons
+	DirectOnly bool
+}
+
+// Registrars and transports by the names used in bridge lines
+var registry = struct {
+	sync.RWMutex
+	registrars map[string]RegistrarSpec
+	transports map[string]TransportSpec
+}{
+	registrars: make(map[string]RegistrarSpec),
+	transports: make(map[string]TransportSpec),
+}
+
+func init() {
+	RegisterRegistrarSpec("bdapi", RegistrarSpec{
+		New: newAPIRegistrar,
+		Validate: func(config *ConjureConfig) error {
+			if config.RegisterURL == "" {
+				return errors.New("API registrar selected with no registration URL")
+			}
+			return nil
+		},
+	})
+	RegisterRegistrarSpec("ampcache", RegistrarSpec{
+		New: newAMPCacheRegistrar,
+		Validate: func(config *ConjureConfig) error {
+			if config.RegisterURL == "" {
+				return errors.New("AMP cache registrar selected with no registration URL")
+			}
+			if config.AMPCacheURL == "" {
+				return errors.New("AMP cache registrar selected with no AMP cache URL")
+			}
+			return nil
+		},
+		// The AMP cache registrar always looks up our address with STUN
+		NeedsUDP: true,
+	})
+	RegisterRegistrarSpec("dns", RegistrarSpec{New: newDNSRegistrar, NeedsUDP: true})
+	RegisterRegistrarSpec("decoy", RegistrarSpec{New: newDecoyRegistrar})
+
+	RegisterTransportSpec("min", TransportSpec{
+		Params: func(*ConjureConfig) (any, error) {
+			return &proto.GenericTransportParams{}, nil
+		},
+	})
+	RegisterTransportSpec("prefix", TransportSpec{
+		Params: func(config *ConjureConfig) (any, error) {
+			return config.prefixParams(), nil
+		},
+	})
+	RegisterTransportSpec("dtls", TransportSpec{
+		Params: func(config *ConjureConfig) (any, error) {
+			return config.dtlsParams(), nil
+		},
+		NeedsUDP: true,
+	})
+}
+
+// RegisterRegistrar makes a registrar available under name, for use in the
+// registrar bridge line argument. It replaces any registrar of the same
+// name, including the built-in ones. It is meant to be called from init
+// functions, before any connections are made.
+func RegisterRegistrar(name string, factory RegistrarFactory) {
+	RegisterRegistrarSpec(name, RegistrarSpec{New: factory})
+}
+
+// RegisterRegistrarSpec is like RegisterRegistrar, but also says what the
+// registrar needs, so that configs it can't work with are rejected by
+// Validate and ValidateProxy
+func RegisterRegistrarSpec(name string, spec RegistrarSpec) {
+	if name == "" || spec.New == nil {
+		panic("conjure: RegisterRegistrar needs a name and a factory")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.registrars[name] = spec
+}
+
+// RegisterTransport makes a transport available under name, for use in the
+// transport bridge line argument. The conjure library must have a client
+// transport of the same name, which transports.AddTransport adds. It
+// replaces the parameters of any transport of the same name, including the
+// built-in ones. It is meant to be called from init functions, before any
+// connections are made.
+func RegisterTransport(name string, params TransportParamsBuilder) {
+	RegisterTransportSpec(name, TransportSpec{Params: params})
+}
+
+// RegisterTransportSpec is like RegisterTransport, but also says what the
+// transport needs, so that it is left out of connections that can't use it
+func RegisterTransportSpec(name string, spec TransportSpec) {
+	if name == "" || spec.Params == nil {
+		panic("conjure: RegisterTransport needs a name and a parameters builder")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.transports[name] = spec
+}
+
+// Registrars returns the names of the available registrars, sorted
+func Registrars() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	return sortedKeys(registry.registrars)
+}
+
+// Transports returns the names of the available transports, sorted
+func Transports() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	return sortedKeys(registry.transports)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupRegistrar(name string) (RegistrarSpec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	spec, ok := registry.registrars[name]
+	return spec, ok
+}
+
+func lookupTransport(name string) (TransportSpec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	spec, ok := registry.transports[name]
+	return spec, ok
+}
+
+// proxyOK reports whether the registrar can be used through an upstream
+// proxy
+func (spec RegistrarSpec) proxyOK() bool {
+	return !spec.NeedsUDP && !spec.DirectOnly
+}
+
+// proxyOK reports whether the transport can be used through an upstream
+// proxy
+func (spec TransportSpec) proxyOK() bool {
+	return !spec.NeedsUDP && !spec.DirectOnly
+}
+
+// withoutUDP removes the transports that need UDP from names
+func withoutUDP(names []string) []string {
+	return filterTransports(names, func(spec TransportSpec) bool { return !spec.NeedsUDP })
+}
+
+// filterTransports returns the transports in names that keep returns true
+// for. Unknown transports are kept, for Validate to report.
+func filterTransports(names []string, keep func(TransportSpec) bool) []string {
+	var filtered []string
+	for _, name := range names {
+		if spec, ok := lookupTransport(name); !ok || keep(spec) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,158 @@
+package conjure
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/refraction-networking/gotapdance/tapdance"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+)
+
+// withRegistry restores the registrars and transports at the end of the test
+func withRegistry(t *testing.T) {
+	registry.Lock()
+	registrars := make(map[string]RegistrarSpec)
+	for name, spec := range registry.registrars {
+		registrars[name] = spec
+	}
+	transports := make(map[string]TransportSpec)
+	for name, spec := range registry.transports {
+		transports[name] = spec
+	}
+	registry.Unlock()
+	t.Cleanup(func() {
+		registry.Lock()
+		registry.registrars = registrars
+		registry.transports = transports
+		registry.Unlock()
+	})
+}
+
+func TestRegisterRegistrar(t *testing.T) {
+	withRegistry(t)
+	station, err := fakestation.Start("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	// A registrar that takes the registration URL from an argument of its own
+	RegisterRegistrar("custom", func(config *ConjureConfig, client *http.Client) (tapdance.Registrar, error) {
+		config = config.Copy()
+		config.RegisterURL = config.Args["custom-url"][0]
+		return newAPIRegistrar(config, client)
+	})
+	if !slices.Contains(Registrars(), "custom") {
+		t.Errorf("expected custom in %v", Registrars())
+	}
+
+	var registrars []string
+	config := &ConjureConfig{
+		Registrars:    []string{"custom"},
+		Transport:     "min",
+		BridgeAddress: "192.0.2.1:80",
+		Args:          map[string][]string{"custom-url": {station.URL}},
+		OnStatus: func(s Status) {
+			if s.Phase == PhaseRegistered {
+				registrars = append(registrars, s.Registrar)
+			}
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Register(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if station.Registrations() != 1 || !slices.Equal(registrars, []string{"custom"}) {
+		t.Errorf("expected one registration through custom, got %d through %v", station.Registrations(), registrars)
+	}
+}
+
+func TestRegisterTransport(t *testing.T) {
+	withRegistry(t)
+	config := &ConjureConfig{Registrars: []string{"dns"}, Transport: "obfs4"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("expected obfs4 to be unknown before it is registered")
+	}
+
+	RegisterTransport("obfs4", func(config *ConjureConfig) (any, error) {
+		return nil, nil
+	})
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(Transports(), []string{"dtls", "min", "obfs4", "prefix"}) {
+		t.Errorf("unexpected transports %v", Transports())
+	}
+}
+
+func TestRegisterSpec(t *testing.T) {
+	withRegistry(t)
+	proxyURL, err := url.Parse("socks5://127.0.0.1:1080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterRegistrarSpec("carrier-pigeon", RegistrarSpec{
+		New: newAPIRegistrar,
+		Validate: func(config *ConjureConfig) error {
+			if len(config.Args["loft"]) == 0 {
+				return errors.New("no loft")
+			}
+			return nil
+		},
+		DirectOnly: true,
+	})
+	RegisterTransportSpec("quic", TransportSpec{
+		Params:   func(*ConjureConfig) (any, error) { return nil, nil },
+		NeedsUDP: true,
+	})
+
+	for _, test := range []struct {
+		name   string
+		config ConjureConfig
+		valid  bool
+	}{
+		{
+			name:   "missing argument",
+			config: ConjureConfig{Registrars: []string{"carrier-pigeon"}},
+		},
+		{
+			name:   "with argument",
+			config: ConjureConfig{Registrars: []string{"carrier-pigeon"}, Args: map[string][]string{"loft": {"roof"}}},
+			valid:  true,
+		},
+		{
+			name:   "registrar through a proxy",
+			config: ConjureConfig{Registrars: []string{"carrier-pigeon"}, Args: map[string][]string{"loft": {"roof"}}, ProxyURL: proxyURL},
+		},
+		{
+			name:   "UDP transport",
+			config: ConjureConfig{Registrars: []string{"decoy"}, Transport: "quic"},
+			valid:  true,
+		},
+		{
+			name:   "UDP transport through a proxy",
+			config: ConjureConfig{Registrars: []string{"decoy"}, Transport: "quic", ProxyURL: proxyURL},
+		},
+		{
+			name:   "UDP transport through a proxy with another transport",
+			config: ConjureConfig{Registrars: []string{"decoy"}, Transport: "quic,min", ProxyURL: proxyURL},
+			valid:  true,
+		},
+	} {
+		if err := test.config.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	if names := withoutUDP([]string{"quic", "min", "dtls"}); !slices.Equal(names, []string{"min"}) {
+		t.Errorf("expected only min without UDP, got %v", names)
+	}
+}
@@ -0,0 +1,141 @@
+package conjure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/turbotunnel"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/session"
+)
+
+type dummyAddr struct{}
+
+func (addr dummyAddr) Network() string { return "dummy" }
+func (addr dummyAddr) String() string  { return "dummy" }
+
+// errSessionClosed is the cause of a session that was closed with Close
+var errSessionClosed = errors.New("session closed")
+
+// SessionConn is a stream to the bridge that outlives the phantom
+// connections it is carried over. Whenever the current phantom connection
+// fails or goes stale, a new phantom is registered and the stream resumes
+// over it.
+type SessionConn struct {
+	*smux.Stream
+	sess  *smux.Session
+	conn  *kcp.UDPSession
+	pconn net.PacketConn
+
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	closeOnce sync.Once
+}
+
+// NewSession opens a session with the bridge in config.BridgeAddress, like
+// DialSession on a Dialer with config.
+func NewSession(config *ConjureConfig) (*SessionConn, error) {
+	d, err := NewDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialSession(context.Background(), config.BridgeAddress)
+}
+
+// DialSession opens a session with the bridge at bridgeAddr. It returns
+// without waiting for the first registration, and data written to the
+// session is sent once a phantom connection is up. Each phantom is dialed
+// with DialContext, so registering one is limited by the retry budget of
+// the config and the deadline of ctx. If registering gives up, or ctx is
+// done, the session is closed, and Err returns why.
+func (d *Dialer) DialSession(ctx context.Context, bridgeAddr string) (*SessionConn, error) {
+	if _, _, err := net.SplitHostPort(bridgeAddr); err != nil {
+		return nil, fmt.Errorf("invalid bridge address %q: %v", bridgeAddr, err)
+	}
+	clientID := turbotunnel.NewClientID()
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	// Each phantom connection carries packets for the same KCP connection.
+	// RedialPacketConn calls dialContext again whenever the current phantom
+	// connection fails.
+	dialContext := func(context.Context) (net.PacketConn, error) {
+		for {
+			phantomConn, err := d.DialContext(ctx, bridgeAddr)
+			if err != nil {
+				log.Printf("Error connecting session %s to a phantom: %s", clientID, err.Error())
+				cancel(err)
+				return nil, err
+			}
+			log.Printf("Session %s connected to a new phantom", clientID)
+			if _, err = phantomConn.Write(session.Token[:]); err == nil {
+				_, err = phantomConn.Write(clientID[:])
+			}
+			if err == nil {
+				return session.NewPacketConn(dummyAddr{}, dummyAddr{}, phantomConn), nil
+			}
+			log.Printf("Error connecting session %s to a phantom: %s", clientID, err.Error())
+			phantomConn.Close()
+		}
+	}
+	pconn := turbotunnel.NewRedialPacketConn(dummyAddr{}, dummyAddr{}, dialContext)
+
+	conn, err := kcp.NewConn2(dummyAddr{}, nil, 0, 0, pconn)
+	if err != nil {
+		cancel(err)
+		pconn.Close()
+		return nil, err
+	}
+	session.ConfigureKCP(conn)
+
+	sess, err := smux.Client(conn, session.SmuxConfig())
+	if err != nil {
+		cancel(err)
+		conn.Close()
+		pconn.Close()
+		return nil, err
+	}
+	stream, err := sess.OpenStream()
+	if err != nil {
+		cancel(err)
+		sess.Close()
+		conn.Close()
+		pconn.Close()
+		return nil, err
+	}
+	c := &SessionConn{Stream: stream, sess: sess, conn: conn, pconn: pconn, ctx: ctx, cancel: cancel}
+	context.AfterFunc(ctx, func() { c.close() })
+	return c, nil
+}
+
+// Err returns why the session was closed without Close being called: the
+// error that registering a phantom gave up with, or the error of the
+// context it was opened with. It returns nil otherwise.
+func (c *SessionConn) Err() error {
+	if err := context.Cause(c.ctx); err != errSessionClosed {
+		return err
+	}
+	return nil
+}
+
+// Close closes the stream and everything under it
+func (c *SessionConn) Close() error {
+	c.cancel(errSessionClosed)
+	return c.close()
+}
+
+func (c *SessionConn) close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Stream.Close()
+		c.sess.Close()
+		c.conn.Close()
+		c.pconn.Close()
+	})
+	return err
+}
@@ -0,0 +1,33 @@
+package conjure
+
+// Phases of connecting to a bridge, reported through ConjureConfig.OnStatus
+const (
+	PhaseRegistering = "registering" // a registration started
+	PhaseFallback    = "fallback"    // a registrar failed and the next one is tried
+	PhaseRegistered  = "registered"  // the station assigned a phantom
+	PhaseConnected   = "connected"   // connected to the bridge through the phantom
+	PhaseFailed      = "failed"      // registering or connecting failed
+	PhaseStale       = "stale"       // nothing came back over the phantom, so it is replaced
+	PhaseUDPBlocked  = "udp-blocked" // UDP seems to be blocked, so transports that need it are tried last
+)
+
+// Status describes progress in connecting to a bridge. Fields that don't
+// apply to the phase are empty.
+type Status struct {
+	Phase     string
+	Bridge    string
+	Registrar string
+	Transport string
+	Prefix    string // ID of the prefix the prefix transport connected with
+	Phantom   string
+	Err       error
+}
+
+// ReportStatus passes s to OnStatus, if it is set, filling in the bridge
+func (c *ConjureConfig) ReportStatus(s Status) {
+	if c.OnStatus == nil {
+		return
+	}
+	s.Bridge = c.BridgeAddress
+	c.OnStatus(s)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	pp "github.com/pires/go-proxyproto"
+	socks "golang.org/x/net/proxy"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+func newSocksConn(target string, args pt.Args) *pt.SocksConn {
+	return &pt.SocksConn{Req: pt.SocksRequest{Target: target, Args: args}}
+}
+
+func TestGetSOCKSArgsIsolation(t *testing.T) {
+	defaults := &conjure.ConjureConfig{
+		Registrars:  []string{"bdapi"},
+		RegisterURL: "https://default.example",
+		Fronts:      []string{"default-front.example"},
+		Transport:   "min",
+	}
+
+	a, err := getSOCKSArgs(newSocksConn("192.0.2.1:80", pt.Args{
+		"url":       []string{"https://a.example"},
+		"fronts":    []string{"a1.example,a2.example"},
+		"transport": []string{"prefix"},
+	}), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := getSOCKSArgs(newSocksConn("192.0.2.2:443", pt.Args{
+		"registrar": []string{"dns"},
+		"transport": []string{"dtls"},
+	}), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.RegisterURL != "https://a.example" || a.Transport != "prefix" ||
+		len(a.Fronts) != 2 || a.BridgeAddress != "192.0.2.1:80" {
+		t.Errorf("unexpected config for first bridge: %+v", a)
+	}
+	if b.Registrars[0] != "dns" || b.Transport != "dtls" ||
+		b.RegisterURL != "https://default.example" || b.BridgeAddress != "192.0.2.2:443" {
+		t.Errorf("unexpected config for second bridge: %+v", b)
+	}
+	if defaults.RegisterURL != "https://default.example" || defaults.Transport != "min" ||
+		defaults.Registrars[0] != "bdapi" || len(defaults.Fronts) != 1 ||
+		defaults.BridgeAddress != "" {
+		t.Errorf("bridge line arguments modified the defaults: %+v", defaults)
+	}
+}
+
+func TestGetSOCKSArgsInvalid(t *testing.T) {
+	defaults := &conjure.ConjureConfig{
+		Registrars:  []string{"bdapi"},
+		RegisterURL: "https://default.example",
+	}
+	for _, args := range []pt.Args{
+		{"transport": []string{"carrier-pigeon"}},
+		{"registrar-timeout": []string{"soon"}},
+		{"registrar": []string{"bdapi"}, "url": []string{""}},
+		{"retry-budget": []string{"-1s"}},
+		{"retry-floor": []string{"10s"}, "retry-ceiling": []string{"1s"}},
+		{"retry-ceiling": []string{"later"}},
+		{"prefix-id": []string{"tls"}},
+		{"prefix-id": []string{"5:0"}},
+		{"prefix-randomize-port": []string{"sometimes"}},
+		{"dtls-unordered": []string{"1"}},
+		{"udp-check": []string{"maybe"}},
+		{"registrar": []string{"decoy"}, "decoy-width": []string{"wide"}},
+		{"registrar": []string{"decoy"}, "decoy-width": []string{"-1"}},
+	} {
+		if _, err := getSOCKSArgs(newSocksConn("192.0.2.1:80", args), defaults); err == nil {
+			t.Errorf("expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestGetSOCKSArgsPrefix(t *testing.T) {
+	defaults := &conjure.ConjureConfig{
+		Registrars:  []string{"bdapi"},
+		RegisterURL: "https://default.example",
+		Transport:   "prefix",
+	}
+	config, err := getSOCKSArgs(newSocksConn("192.0.2.1:80", pt.Args{
+		"prefix-id":             []string{"5:3,1"},
+		"prefix-randomize-port": []string{"false"},
+	}), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []conjure.PrefixWeight{{ID: 5, Weight: 3}, {ID: 1, Weight: 1}}
+	if config.Args["prefix-id"][0] != "5:3,1" {
+		t.Errorf("expected the bridge line arguments to be kept, got %v", config.Args)
+	}
+	if !slices.Equal(config.Prefixes, expected) || !config.PrefixDefaultPort {
+		t.Errorf("expected prefixes %v on their usual ports, got %v, %v", expected, config.Prefixes, config.PrefixDefaultPort)
+	}
+	if defaults.Prefixes != nil || defaults.PrefixDefaultPort {
+		t.Errorf("bridge line arguments modified the defaults: %+v", defaults)
+	}
+}
+
+func TestGetSOCKSArgsDTLS(t *testing.T) {
+	defaults := &conjure.ConjureConfig{
+		Registrars:    []string{"dns"},
+		Transport:     "dtls",
+		DTLSUnordered: true,
+	}
+	config, err := getSOCKSArgs(newSocksConn("192.0.2.1:80", pt.Args{
+		"dtls-randomize-port": []string{"no"},
+		"dtls-unordered":      []string{"false"},
+		"udp-check":           []string{"false"},
+	}), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.DTLSDefaultPort || config.DTLSUnordered || !config.SkipUDPCheck {
+		t.Errorf("unexpected dtls options: %+v", config)
+	}
+	if defaults.DTLSDefaultPort || !defaults.DTLSUnordered || defaults.SkipUDPCheck {
+		t.Errorf("bridge line arguments modified the defaults: %+v", defaults)
+	}
+}
+
+func TestGetSOCKSArgsDefaultBridge(t *testing.T) {
+	defaults := &conjure.ConjureConfig{
+		Registrars:    []string{"bdapi"},
+		RegisterURL:   "https://default.example",
+		BridgeAddress: "192.0.2.1:80",
+	}
+	config, err := getSOCKSArgs(newSocksConn("example.com:443", nil), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BridgeAddress != "192.0.2.1:80" {
+		t.Errorf("expected the default bridge to replace the SOCKS target, got %q", config.BridgeAddress)
+	}
+}
+
+// startBridge starts an echo server behind a PROXY protocol listener,
+// standing in for the bridge
+func startBridge(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppln := &pp.Listener{Listener: ln, ReadHeaderTimeout: time.Second}
+	t.Cleanup(func() { ppln.Close() })
+	go func() {
+		for {
+			conn, err := ppln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestStandaloneSOCKS(t *testing.T) {
+	station, err := fakestation.Start(startBridge(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go acceptLoop(ln, &conjure.ConjureConfig{
+		Registrars:    []string{"bdapi"},
+		RegisterURL:   "https://unused.example",
+		Transport:     "dtls",
+		BridgeAddress: "192.0.2.1:80",
+	})
+
+	// Bridge arguments are passed in the username and password, and the
+	// target the application asks for is replaced by the default bridge
+	dialer, err := socks.SOCKS5("tcp", ln.Addr().String(), &socks.Auth{
+		User:     "transport=min;",
+		Password: "url=" + station.URL,
+	}, socks.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	msg := []byte("hello through the standalone proxy")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("expected %q to be echoed, got %q", msg, buf)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	// A registration URL that refuses connections
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go acceptLoop(ln, &conjure.ConjureConfig{
+		Registrars:    []string{"bdapi"},
+		RegisterURL:   "http://" + closed.Addr().String(),
+		Transport:     "min",
+		BridgeAddress: "192.0.2.1:80",
+		RetryFloor:    10 * time.Millisecond,
+		RetryCeiling:  20 * time.Millisecond,
+		RetryBudget:   200 * time.Millisecond,
+	})
+
+	dialer, err := socks.SOCKS5("tcp", ln.Addr().String(), nil, socks.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The SOCKS connection is granted right away, and closed once the
+	// retry budget runs out
+	conn.SetReadDeadline(start.Add(10 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected retries to go on for the retry budget, gave up after %v", elapsed)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+)
+
+// methodPresets are the bridge line arguments that each client method
+// applies on top of the command line and config file options. Tor only
+// accepts method names made of letters, digits and underscores.
+var methodPresets = map[string]pt.Args{
+	"conjure":          {},
+	"conjure_min":      {"transport": {"min"}},
+	"conjure_prefix":   {"transport": {"prefix"}},
+	"conjure_dtls":     {"transport": {"dtls"}},
+	"conjure_auto":     {"transport": {conjure.TransportAuto}},
+	"conjure_dns":      {"registrar": {"dns"}},
+	"conjure_ampcache": {"registrar": {"ampcache"}},
+	"conjure_decoy":    {"registrar": {"decoy"}},
+}
+
+// Client methods, the presets and any from the config file
+var methods = methodPresets
+
+var methodNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// addMethods adds methods from the config file, replacing presets of the
+// same name
+func addMethods(fileMethods map[string]map[string]string) error {
+	methods = make(map[string]pt.Args)
+	for name, args := range methodPresets {
+		methods[name] = args
+	}
+	for name, args := range fileMethods {
+		if !methodNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid method name %q, must be made of letters, digits and underscores", name)
+		}
+		methods[name] = make(pt.Args)
+		for k, v := range args {
+			methods[name].Add(k, v)
+		}
+	}
+	return nil
+}
+
+// methodDefaults returns a copy of defaults with the arguments of the named
+// method applied. Bridge lines and config file options for the bridge still
+// override them.
+func methodDefaults(defaults *conjure.ConjureConfig, name string) (*conjure.ConjureConfig, error) {
+	args, ok := methods[name]
+	if !ok {
+		return nil, errors.New("no such method")
+	}
+	config := defaults.Copy()
+	if err := applyArgs(config, args); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
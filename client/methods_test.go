@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+)
+
+// setMethods adds methods from a config file for the rest of the test
+func setMethods(t *testing.T, fileMethods map[string]map[string]string) {
+	if err := addMethods(fileMethods); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { methods = methodPresets })
+}
+
+func TestMethodDefaults(t *testing.T) {
+	setMethods(t, map[string]map[string]string{
+		"conjure_prefix": {"transport": "prefix", "pool-size": "2"},
+		"conjure_fast":   {"transport": "auto", "registrar": "bdapi,dns"},
+	})
+	defaults := &conjure.ConjureConfig{
+		Registrars:  []string{"bdapi"},
+		RegisterURL: "https://default.example",
+		Transport:   "min",
+		PoolMaxAge:  conjure.DefaultPoolMaxAge,
+	}
+
+	for name, expected := range map[string]struct {
+		transport  string
+		registrars int
+		poolSize   int
+	}{
+		"conjure":        {"min", 1, 0},
+		"conjure_dtls":   {"dtls", 1, 0},
+		"conjure_prefix": {"prefix", 1, 2},
+		"conjure_fast":   {"auto", 2, 0},
+	} {
+		config, err := methodDefaults(defaults, name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if config.Transport != expected.transport || len(config.Registrars) != expected.registrars ||
+			config.PoolSize != expected.poolSize {
+			t.Errorf("%s: unexpected config %+v", name, config)
+		}
+	}
+	if defaults.Transport != "min" || len(defaults.Registrars) != 1 {
+		t.Errorf("methods modified the defaults: %+v", defaults)
+	}
+
+	// Bridge lines override the method
+	methodConfig, err := methodDefaults(defaults, "conjure_dtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := getSOCKSArgs(newSocksConn("192.0.2.1:80", pt.Args{"transport": {"prefix"}}), methodConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Transport != "prefix" {
+		t.Errorf("expected the bridge line to override the method, got %s", config.Transport)
+	}
+
+	if _, err := methodDefaults(defaults, "obfs4"); err == nil {
+		t.Error("expected an unknown method to be rejected")
+	}
+}
+
+func TestAddMethodsInvalidName(t *testing.T) {
+	defer func() { methods = methodPresets }()
+	if err := addMethods(map[string]map[string]string{"conjure-fast": {}}); err == nil {
+		t.Error("expected a method name that tor rejects to be rejected")
+	}
+}
+
+func TestSetupManagedProxyMethods(t *testing.T) {
+	var buf bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &buf
+	defer func() { pt.Stdout = stdout }()
+	t.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1")
+	t.Setenv("TOR_PT_CLIENT_TRANSPORTS", "conjure,conjure_dtls,obfs4")
+
+	defaults := &conjure.ConjureConfig{Registrars: []string{"bdapi"}, Transport: "min"}
+	listeners := setupManagedProxy(defaults, false)
+	for _, ln := range listeners {
+		defer ln.Close()
+	}
+	if len(listeners) != 2 {
+		t.Errorf("expected 2 listeners, got %d", len(listeners))
+	}
+	for _, line := range []string{
+		`(?m)^CMETHOD conjure socks5 127\.0\.0\.1:\d+$`,
+		`(?m)^CMETHOD conjure_dtls socks5 127\.0\.0\.1:\d+$`,
+		`(?m)^CMETHOD-ERROR obfs4 no such method$`,
+		`(?m)^CMETHODS DONE$`,
+	} {
+		if !regexp.MustCompile(line).Match(buf.Bytes()) {
+			t.Errorf("expected a line matching %s in:\n%s", line, buf.String())
+		}
+	}
+}
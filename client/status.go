@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+)
+
+// ptStatus returns a function that reports the progress of connections
+// made for a client method to tor in STATUS lines, which tor passes on to
+// controllers for bootstrap reporting. Phantom addresses and errors are
+// scrubbed like the log unless unsafeLogging is set.
+func ptStatus(method string, unsafeLogging bool) func(conjure.Status) {
+	scrub := func(s string) string {
+		if unsafeLogging {
+			return s
+		}
+		return string(safelog.Scrub([]byte(s)))
+	}
+	return func(s conjure.Status) {
+		fields := []string{"STATUS", "TRANSPORT=" + statusValue(method)}
+		if s.Bridge != "" {
+			fields = append(fields, "ADDRESS="+statusValue(s.Bridge))
+		}
+		fields = append(fields, "PHASE="+statusValue(s.Phase))
+		if s.Registrar != "" {
+			fields = append(fields, "REGISTRAR="+statusValue(s.Registrar))
+		}
+		if s.Transport != "" {
+			fields = append(fields, "CONJURE_TRANSPORT="+statusValue(s.Transport))
+		}
+		if s.Prefix != "" {
+			fields = append(fields, "PREFIX="+statusValue(s.Prefix))
+		}
+		if s.Phantom != "" {
+			fields = append(fields, "PHANTOM="+statusValue(scrub(s.Phantom)))
+		}
+		if s.Err != nil {
+			fields = append(fields, "ERROR="+encodeCString(scrub(s.Err.Error())))
+		}
+		fmt.Fprintln(pt.Stdout, strings.Join(fields, " "))
+	}
+}
+
+// logStatus returns a function that logs the progress of connections, and
+// then passes it on to next if that is set. The logger carries the session id
+// of the SOCKS connection, so that JSON logs can be grouped by connection.
+func logStatus(logger *slog.Logger, next func(conjure.Status)) func(conjure.Status) {
+	return func(s conjure.Status) {
+		attrs := []any{"phase", s.Phase, "bridge", s.Bridge}
+		if s.Registrar != "" {
+			attrs = append(attrs, "registrar", s.Registrar)
+		}
+		if s.Transport != "" {
+			attrs = append(attrs, "transport", s.Transport)
+		}
+		if s.Prefix != "" {
+			attrs = append(attrs, "prefix", s.Prefix)
+		}
+		if s.Phantom != "" {
+			attrs = append(attrs, "phantom", s.Phantom)
+		}
+		if s.Err != nil {
+			attrs = append(attrs, "error", s.Err)
+		}
+		logger.Info("Connection status", attrs...)
+		if next != nil {
+			next(s)
+		}
+	}
+}
+
+// statusValue returns s as it is if it is a plain STATUS value, and quoted
+// as a CString otherwise, so that a value with spaces, quotes or line breaks
+// can't add fields or lines of its own
+func statusValue(s string) string {
+	if s == "" {
+		return encodeCString(s)
+	}
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 127 || c == '"' || c == '\\' {
+			return encodeCString(s)
+		}
+	}
+	return s
+}
+
+// encodeCString quotes s as a CString (control-spec.txt section 2.1.1), as
+// goptlib does for LOG messages
+func encodeCString(s string) string {
+	var result bytes.Buffer
+	result.WriteByte('"')
+	for _, c := range []byte(s) {
+		if c == 32 || c == 33 || (35 <= c && c <= 91) || (93 <= c && c <= 126) {
+			result.WriteByte(c)
+		} else {
+			fmt.Fprintf(&result, "\\%03o", c)
+		}
+	}
+	result.WriteByte('"')
+	return result.String()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"testing"
+
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+)
+
+func TestPTStatus(t *testing.T) {
+	var buf bytes.Buffer
+	stdout := pt.Stdout
+	pt.Stdout = &buf
+	defer func() { pt.Stdout = stdout }()
+
+	for _, test := range []struct {
+		unsafe   bool
+		status   conjure.Status
+		expected string
+	}{
+		{
+			status:   conjure.Status{Phase: conjure.PhaseRegistered, Bridge: "192.0.2.1:80", Registrar: "bdapi"},
+			expected: "STATUS TRANSPORT=conjure ADDRESS=192.0.2.1:80 PHASE=registered REGISTRAR=bdapi\n",
+		},
+		{
+			status:   conjure.Status{Phase: conjure.PhaseConnected, Bridge: "192.0.2.1:80", Transport: "min", Phantom: "192.0.2.7:443"},
+			expected: "STATUS TRANSPORT=conjure ADDRESS=192.0.2.1:80 PHASE=connected CONJURE_TRANSPORT=min PHANTOM=[scrubbed]\n",
+		},
+		{
+			unsafe:   true,
+			status:   conjure.Status{Phase: conjure.PhaseConnected, Bridge: "192.0.2.1:80", Transport: "min", Phantom: "192.0.2.7:443"},
+			expected: "STATUS TRANSPORT=conjure ADDRESS=192.0.2.1:80 PHASE=connected CONJURE_TRANSPORT=min PHANTOM=192.0.2.7:443\n",
+		},
+		{
+			status:   conjure.Status{Phase: conjure.PhaseConnected, Bridge: "192.0.2.1:80", Transport: "prefix", Prefix: "4"},
+			expected: "STATUS TRANSPORT=conjure ADDRESS=192.0.2.1:80 PHASE=connected CONJURE_TRANSPORT=prefix PREFIX=4\n",
+		},
+		{
+			status:   conjure.Status{Phase: conjure.PhaseFailed, Bridge: "192.0.2.1:80", Err: errors.New("dial 192.0.2.7:443: \"refused\"")},
+			expected: "STATUS TRANSPORT=conjure ADDRESS=192.0.2.1:80 PHASE=failed ERROR=\"dial [scrubbed]: \\042refused\\042\"\n",
+		},
+		{
+			status:   conjure.Status{Phase: conjure.PhaseConnected, Bridge: "192.0.2.1:80", Transport: "evil PHASE=x\nSTATUS", Registrar: "a\"b"},
+			expected: "STATUS TRANSPORT=conjure ADDRESS=192.0.2.1:80 PHASE=connected REGISTRAR=\"a\\042b\" CONJURE_TRANSPORT=\"evil PHASE=x\\012STATUS\"\n",
+		},
+	} {
+		buf.Reset()
+		ptStatus("conjure", test.unsafe)(test.status)
+		if buf.String() != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, buf.String())
+		}
+	}
+}
+
+func TestLogStatus(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil)).With("session", 7)
+	var passed []conjure.Status
+	report := logStatus(logger, func(s conjure.Status) { passed = append(passed, s) })
+
+	status := conjure.Status{Phase: conjure.PhaseFailed, Bridge: "192.0.2.1:80", Registrar: "dns", Err: errors.New("timed out")}
+	report(status)
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]any{
+		"session":   7.0,
+		"phase":     "failed",
+		"bridge":    "192.0.2.1:80",
+		"registrar": "dns",
+		"error":     "timed out",
+	} {
+		if record[k] != v {
+			t.Errorf("expected %s to be %v in %v", k, v, record)
+		}
+	}
+	if _, ok := record["transport"]; ok {
+		t.Errorf("expected no transport in %v", record)
+	}
+	if len(passed) != 1 || passed[0] != status {
+		t.Errorf("expected the status to be passed on, got %v", passed)
+	}
+}
+
+func TestStatusPhases(t *testing.T) {
+	station, err := fakestation.Start(startBridge(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	var phases []string
+	conn, err := conjure.Register(&conjure.ConjureConfig{
+		Registrars:    []string{"bdapi"},
+		RegisterURL:   station.URL,
+		Transport:     "min",
+		BridgeAddress: "192.0.2.1:80",
+		OnStatus: func(s conjure.Status) {
+			if s.Bridge != "192.0.2.1:80" {
+				t.Errorf("expected the bridge address in %+v", s)
+			}
+			phases = append(phases, s.Phase)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	expected := []string{conjure.PhaseRegistering, conjure.PhaseRegistered, conjure.PhaseConnected}
+	if !slices.Equal(phases, expected) {
+		t.Errorf("expected phases %v, got %v", expected, phases)
+	}
+}
@@ -5,13 +5,20 @@ go 1.22.0
 toolchain go1.24.4
 
 require (
+	github.com/pelletier/go-toml v1.9.5
+	github.com/pion/stun v0.6.1
 	github.com/pires/go-proxyproto v0.8.0
 	github.com/refraction-networking/conjure v0.9.1
 	github.com/refraction-networking/gotapdance v1.7.10
 	github.com/refraction-networking/utls v1.6.7
+	github.com/sirupsen/logrus v1.9.3
+	github.com/xtaci/kcp-go/v5 v5.6.8
+	github.com/xtaci/smux v1.5.34
 	gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib v1.6.0
 	gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil v0.0.0-20250130151315-efaf4e0ec0d3
 	gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2 v2.11.0
+	golang.org/x/net v0.35.0
+	google.golang.org/protobuf v1.36.5
 )
 
 require (
@@ -21,33 +28,31 @@ require (
 	github.com/cloudflare/circl v1.5.0 // indirect
 	github.com/dchest/siphash v1.2.3 // indirect
 	github.com/flynn/noise v1.1.0 // indirect
-	github.com/gaukas/godicttls v0.0.4 // indirect
-	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/klauspost/compress v1.17.11 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/klauspost/reedsolomon v1.12.0 // indirect
 	github.com/libp2p/go-reuseport v0.4.0 // indirect
 	github.com/mroth/weightedrand v1.0.0 // indirect
-	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/pion/dtls/v2 v2.2.12 // indirect
 	github.com/pion/logging v0.2.3 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
 	github.com/pion/sctp v1.8.37 // indirect
-	github.com/pion/stun v0.6.1 // indirect
 	github.com/pion/transport/v2 v2.2.10 // indirect
 	github.com/pion/transport/v3 v3.0.7 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
 	github.com/refraction-networking/ed25519 v0.1.2 // indirect
 	github.com/refraction-networking/obfs4 v0.1.2 // indirect
 	github.com/sergeyfrolov/bsbuffer v0.0.0-20180903213811-94e85abb8507 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
+	github.com/templexxx/cpu v0.1.0 // indirect
+	github.com/templexxx/xorsimd v0.4.2 // indirect
+	github.com/tjfoc/gmsm v1.4.1 // indirect
 	github.com/wlynxg/anet v0.0.5 // indirect
 	golang.org/x/crypto v0.33.0 // indirect
-	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
-	google.golang.org/protobuf v1.36.5 // indirect
 )
 
 replace (
 	github.com/pion/dtls/v2 => github.com/mingyech/dtls/v2 v2.0.0
 	github.com/refraction-networking/conjure v0.7.11 => github.com/refraction-networking/conjure v0.7.12-0.20250507182851-8676ab6282b8
-
 )
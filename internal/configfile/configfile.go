@@ -0,0 +1,215 @@
+// Package configfile reads configuration files for the client and the
+// bridge.
+//
+// A file is TOML if its name ends in .toml, and JSON otherwise. Its
+// top-level keys are the names of command-line flags, and their values are
+// strings, numbers, booleans, or arrays, which are joined with commas for
+// flags that take comma-separated lists. Values from the file take
+// precedence over the command line. The client also reads a "bridges"
+// table, which maps bridge addresses to tables of bridge line arguments, and
+// a "methods" table, which maps client method names to tables of bridge line
+// arguments.
+//
+//	registrar = ["bdapi", "dns"]
+//	retry-budget = "5m"
+//
+//	[bridges."192.0.2.1:80"]
+//	transport = "prefix"
+//
+//	[methods.conjure_fast]
+//	transport = "auto"
+//	pool-size = 2
+package configfile
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Keys of the tables of bridge line arguments
+const (
+	BridgesKey = "bridges"
+	MethodsKey = "methods"
+)
+
+// File is a parsed configuration file
+type File struct {
+	// Options are the values of flags, by flag name
+	Options map[string]string
+	// Bridges are bridge line arguments, by bridge address
+	Bridges map[string]map[string]string
+	// Methods are bridge line arguments, by client method name
+	Methods map[string]map[string]string
+}
+
+// Load reads the configuration file at path
+func Load(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if strings.HasSuffix(path, ".toml") {
+		tree, err := toml.LoadBytes(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		m = tree.ToMap()
+	} else if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	f, err := parse(m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
+}
+
+func parse(m map[string]any) (*File, error) {
+	f := &File{Options: make(map[string]string)}
+	for k, v := range m {
+		var err error
+		switch k {
+		case BridgesKey:
+			f.Bridges, err = parseTables(k, v)
+		case MethodsKey:
+			f.Methods, err = parseTables(k, v)
+		default:
+			f.Options[k], err = format(v)
+			if err != nil {
+				err = fmt.Errorf("%s: %v", k, err)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// parseTables parses a table of tables of bridge line arguments
+func parseTables(key string, v any) (map[string]map[string]string, error) {
+	tables, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a table of tables", key)
+	}
+	parsed := make(map[string]map[string]string)
+	for name, v := range tables {
+		args, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s %s must be a table of bridge line arguments", key, name)
+		}
+		parsed[name] = make(map[string]string)
+		for arg, v := range args {
+			s, err := format(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %s: %v", key, name, arg, err)
+			}
+			parsed[name][arg] = s
+		}
+	}
+	return parsed, nil
+}
+
+// format turns a value from the file into the string that would be given on
+// the command line
+func format(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := format(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// Apply sets the flags in fs to the options in the file. The flags named in
+// skip, such as the one naming the file, cannot be set from it.
+func (f *File) Apply(fs *flag.FlagSet, skip ...string) error {
+	var errs []error
+	for _, name := range sortedKeys(f.Options) {
+		if fs.Lookup(name) == nil || slices.Contains(skip, name) {
+			errs = append(errs, fmt.Errorf("unknown option %q", name))
+			continue
+		}
+		if err := fs.Set(name, f.Options[name]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Print writes the values of the flags in fs, except those named in skip,
+// and the tables of bridge line arguments in tables as a TOML file. The
+// options in tables are not printed, since the flags hold their values.
+func Print(w io.Writer, fs *flag.FlagSet, tables *File, skip ...string) error {
+	m := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(skip, f.Name) {
+			return
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			m[f.Name] = f.Value.String() == "true"
+		} else {
+			m[f.Name] = f.Value.String()
+		}
+	})
+	if tables != nil {
+		for key, table := range map[string]map[string]map[string]string{
+			BridgesKey: tables.Bridges,
+			MethodsKey: tables.Methods,
+		} {
+			if len(table) == 0 {
+				continue
+			}
+			values := make(map[string]any)
+			for name, args := range table {
+				argValues := make(map[string]any)
+				for k, v := range args {
+					argValues[k] = v
+				}
+				values[name] = argValues
+			}
+			m[key] = values
+		}
+	}
+	tree, err := toml.TreeFromMap(m)
+	if err != nil {
+		return err
+	}
+	_, err = tree.WriteTo(w)
+	return err
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,163 @@
+package configfile
+
+import (
+	"bytes"
+	"flag"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newFlagSet returns flags like the client's
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("registrar", "bdapi", "")
+	fs.Bool("session", false, "")
+	fs.Int("pool-size", 0, "")
+	fs.Duration("retry-budget", 10*time.Minute, "")
+	fs.String("config", "", "")
+	return fs
+}
+
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	expected := &File{
+		Options: map[string]string{
+			"registrar":    "bdapi,dns",
+			"session":      "true",
+			"pool-size":    "2",
+			"retry-budget": "5m",
+		},
+		Bridges: map[string]map[string]string{
+			"192.0.2.1:80": {"transport": "prefix", "pool-size": "1"},
+		},
+		Methods: map[string]map[string]string{
+			"conjure_fast": {"transport": "auto"},
+		},
+	}
+	for name, contents := range map[string]string{
+		"conjure.toml": `
+registrar = ["bdapi", "dns"]
+session = true
+pool-size = 2
+retry-budget = "5m"
+
+[bridges."192.0.2.1:80"]
+transport = "prefix"
+pool-size = 1
+
+[methods.conjure_fast]
+transport = "auto"
+`,
+		"conjure.json": `{
+	"registrar": ["bdapi", "dns"],
+	"session": true,
+	"pool-size": 2,
+	"retry-budget": "5m",
+	"bridges": {"192.0.2.1:80": {"transport": "prefix", "pool-size": 1}},
+	"methods": {"conjure_fast": {"transport": "auto"}}
+}`,
+	} {
+		f, err := Load(writeFile(t, name, contents))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !maps.Equal(f.Options, expected.Options) {
+			t.Errorf("%s: expected options %v, got %v", name, expected.Options, f.Options)
+		}
+		if len(f.Bridges) != 1 || !maps.Equal(f.Bridges["192.0.2.1:80"], expected.Bridges["192.0.2.1:80"]) {
+			t.Errorf("%s: expected bridges %v, got %v", name, expected.Bridges, f.Bridges)
+		}
+		if len(f.Methods) != 1 || !maps.Equal(f.Methods["conjure_fast"], expected.Methods["conjure_fast"]) {
+			t.Errorf("%s: expected methods %v, got %v", name, expected.Methods, f.Methods)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, contents := range map[string]string{
+		"syntax.toml":  "registrar = ",
+		"syntax.json":  "{",
+		"nested.toml":  "[registrar]\nname = \"bdapi\"",
+		"bridges.json": `{"bridges": ["192.0.2.1:80"]}`,
+		"bridge.json":  `{"bridges": {"192.0.2.1:80": "prefix"}}`,
+		"method.toml":  "[methods]\nconjure_fast = \"auto\"",
+	} {
+		if _, err := Load(writeFile(t, name, contents)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := newFlagSet()
+	// The file overrides the command line
+	if err := fs.Parse([]string{"-registrar", "ampcache", "-pool-size", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	f := &File{Options: map[string]string{"registrar": "dns", "retry-budget": "5m"}}
+	if err := f.Apply(fs, "config"); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"registrar":    "dns",
+		"pool-size":    "3",
+		"retry-budget": "5m0s",
+	} {
+		if value := fs.Lookup(name).Value.String(); value != expected {
+			t.Errorf("expected %s to be %s, got %s", name, expected, value)
+		}
+	}
+
+	for _, options := range []map[string]string{
+		{"unknown": "1"},
+		{"config": "other.toml"},
+		{"pool-size": "many"},
+	} {
+		f := &File{Options: options}
+		if err := f.Apply(newFlagSet(), "config"); err == nil {
+			t.Errorf("expected %v to be rejected", options)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	fs := newFlagSet()
+	fs.Set("registrar", "bdapi,dns")
+	bridges := map[string]map[string]string{"192.0.2.1:80": {"transport": "prefix"}}
+	methods := map[string]map[string]string{"conjure_fast": {"transport": "auto"}}
+	var buf bytes.Buffer
+	if err := Print(&buf, fs, &File{Bridges: bridges, Methods: methods}, "config"); err != nil {
+		t.Fatal(err)
+	}
+
+	// What is printed can be read back
+	f, err := Load(writeFile(t, "printed.toml", buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"registrar":    "bdapi,dns",
+		"session":      "false",
+		"pool-size":    "0",
+		"retry-budget": "10m0s",
+	}
+	if !maps.Equal(f.Options, expected) {
+		t.Errorf("expected options %v, got %v", expected, f.Options)
+	}
+	if !maps.Equal(f.Bridges["192.0.2.1:80"], bridges["192.0.2.1:80"]) {
+		t.Errorf("expected bridges %v, got %v", bridges, f.Bridges)
+	}
+	if !maps.Equal(f.Methods["conjure_fast"], methods["conjure_fast"]) {
+		t.Errorf("expected methods %v, got %v", methods, f.Methods)
+	}
+}
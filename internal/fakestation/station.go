@@ -0,0 +1,377 @@
+// Package fakestation provides a stand-in for a Conjure station, so that the
+// client and the bridge can be tested end to end on loopback without the real
+// deployment.
+//
+// The station answers bidirectional registrations made through the API
+// (/api/register-bidirectional) and through an AMP cache
+// (/amp/register-bidirectional), always assigning its own loopback phantom
+// listener as the phantom. A connection to the phantom that starts with the
+// tag of a registered min transport session is forwarded to the bridge, with
+// a PROXY protocol header carrying the client's address, as a real station
+// would do. Only the min transport is supported. With WithStationKey, the
+// PROXY headers are signed as described in package stationauth, and with
+// WithClientConf, clients with an older ClientConf are sent a newer one.
+package fakestation
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	pp "github.com/pires/go-proxyproto"
+	"github.com/refraction-networking/conjure/pkg/core"
+	pb "github.com/refraction-networking/conjure/proto"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/amp"
+	"google.golang.org/protobuf/proto"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/stationauth"
+)
+
+const (
+	apiPath = "/api/register-bidirectional"
+	ampPath = "/amp/register-bidirectional/"
+
+	// The string the min transport uses to derive its connection tag
+	minTransportHMACString = "MinTrasportHMACString"
+	minTransportTagLen     = 32
+
+	// Time allowed for a phantom connection to send its tag
+	tagTimeout = 5 * time.Second
+)
+
+// Station is a fake Conjure station listening on loopback
+type Station struct {
+	// URL is the base URL of the registration API, to be used as the
+	// client's RegisterURL or as a domain front for AMP cache registrations
+	URL string
+	// STUNAddr is the address of a STUN server that reports the address
+	// requests come from
+	STUNAddr string
+
+	bridgeAddr string
+	name       string
+	key        []byte
+	clientConf *pb.ClientConf
+
+	httpLn    net.Listener
+	phantomLn net.Listener
+	stunConn  net.PacketConn
+	server    *http.Server
+
+	lock          sync.Mutex
+	tags          map[string]bool
+	registrations int
+	conns         map[net.Conn]struct{}
+
+	wg sync.WaitGroup
+}
+
+// Option configures a Station
+type Option func(*Station)
+
+// WithStationKey makes the station sign its PROXY headers as the named
+// station with key
+func WithStationKey(name string, key []byte) Option {
+	return func(s *Station) {
+		s.name = name
+		s.key = key
+	}
+}
+
+// WithClientConf makes the station send conf in its registration responses,
+// as a station with a newer ClientConf than the client's does
+func WithClientConf(conf *pb.ClientConf) Option {
+	return func(s *Station) {
+		s.clientConf = conf
+	}
+}
+
+// Start starts a station that forwards phantom connections to the bridge
+// listening at bridgeAddr.
+func Start(bridgeAddr string, opts ...Option) (*Station, error) {
+	s := &Station{
+		bridgeAddr: bridgeAddr,
+		tags:       make(map[string]bool),
+		conns:      make(map[net.Conn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	var err error
+	if s.httpLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	if s.phantomLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		s.httpLn.Close()
+		return nil, err
+	}
+	if s.stunConn, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		s.httpLn.Close()
+		s.phantomLn.Close()
+		return nil, err
+	}
+	s.URL = "http://" + s.httpLn.Addr().String()
+	s.STUNAddr = s.stunConn.LocalAddr().String()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPath, s.handleAPI)
+	mux.HandleFunc("/", s.handleAMP)
+	s.server = &http.Server{Handler: mux}
+
+	s.wg.Add(3)
+	go func() {
+		defer s.wg.Done()
+		s.server.Serve(s.httpLn)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.acceptPhantoms()
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.serveSTUN()
+	}()
+	return s, nil
+}
+
+// PhantomAddr returns the address of the phantom listener
+func (s *Station) PhantomAddr() net.Addr {
+	return s.phantomLn.Addr()
+}
+
+// Registrations returns the number of successful registrations
+func (s *Station) Registrations() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.registrations
+}
+
+// DropConnections closes all forwarded connections, as a phantom that goes
+// away would
+func (s *Station) DropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the station and closes all forwarded connections
+func (s *Station) Close() error {
+	err := s.server.Close()
+	s.phantomLn.Close()
+	s.stunConn.Close()
+	s.DropConnections()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Station) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := s.register(payload)
+	if err != nil {
+		log.Printf("fake station: API registration failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(resp)
+}
+
+// handleAMP answers registrations sent through an AMP cache. The path is
+// either the origin path or the AMP cache form of it, which has a prefix
+// like /c/s/<host>.
+func (s *Station) handleAMP(w http.ResponseWriter, r *http.Request) {
+	i := strings.Index(r.URL.Path, ampPath)
+	if i < 0 || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	payload, err := amp.DecodePath(r.URL.Path[i+len(ampPath):])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := s.register(payload)
+	if err != nil {
+		log.Printf("fake station: AMP cache registration failed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	enc, err := amp.NewArmorEncoder(w)
+	if err != nil {
+		return
+	}
+	enc.Write(resp)
+	enc.Close()
+}
+
+// register records the registration in payload and returns the
+// serialized registration response
+func (s *Station) register(payload []byte) ([]byte, error) {
+	c2s := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(payload, c2s); err != nil {
+		return nil, err
+	}
+	if len(c2s.GetSharedSecret()) == 0 {
+		return nil, errors.New("registration has no shared secret")
+	}
+	if transport := c2s.GetRegistrationPayload().GetTransport(); transport != pb.TransportType_Min {
+		return nil, fmt.Errorf("transport %v is not supported", transport)
+	}
+
+	phantom := s.phantomLn.Addr().(*net.TCPAddr)
+	resp := &pb.RegistrationResponse{
+		Ipv4Addr: proto.Uint32(binary.BigEndian.Uint32(phantom.IP.To4())),
+		DstPort:  proto.Uint32(uint32(phantom.Port)),
+	}
+	if s.clientConf != nil && c2s.GetRegistrationPayload().GetDecoyListGeneration() < s.clientConf.GetGeneration() {
+		resp.ClientConf = s.clientConf
+	}
+	buf, err := proto.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := core.ConjureHMAC(c2s.GetSharedSecret(), minTransportHMACString)
+	s.lock.Lock()
+	s.tags[string(tag)] = true
+	s.registrations++
+	s.lock.Unlock()
+	return buf, nil
+}
+
+func (s *Station) acceptPhantoms() {
+	for {
+		conn, err := s.phantomLn.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.handlePhantom(conn); err != nil {
+				log.Printf("fake station: phantom connection: %v", err)
+			}
+		}()
+	}
+}
+
+// track adds conn to the connections closed by Close, and returns a
+// function that removes it again
+func (s *Station) track(conn net.Conn) func() {
+	s.lock.Lock()
+	s.conns[conn] = struct{}{}
+	s.lock.Unlock()
+	return func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}
+}
+
+func (s *Station) handlePhantom(conn net.Conn) error {
+	defer s.track(conn)()
+
+	tag := make([]byte, minTransportTagLen)
+	conn.SetReadDeadline(time.Now().Add(tagTimeout))
+	if _, err := io.ReadFull(conn, tag); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.lock.Lock()
+	registered := s.tags[string(tag)]
+	s.lock.Unlock()
+	if !registered {
+		return errors.New("connection tag does not match any registration")
+	}
+
+	bridge, err := net.Dial("tcp", s.bridgeAddr)
+	if err != nil {
+		return err
+	}
+	defer s.track(bridge)()
+
+	header := pp.HeaderProxyFromAddrs(1, conn.RemoteAddr(), bridge.RemoteAddr())
+	if s.key != nil {
+		if err := stationauth.Sign(header, s.name, s.key, time.Now()); err != nil {
+			return err
+		}
+	}
+	if _, err := header.WriteTo(bridge); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(bridge, conn)
+		closeWrite(bridge)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, bridge)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+	return nil
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(*net.TCPConn); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// serveSTUN answers STUN binding requests with the address they came from
+func (s *Station) serveSTUN() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.stunConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := &stun.Message{Raw: bytes.Clone(buf[:n])}
+		if err := req.Decode(); err != nil || req.Type != stun.BindingRequest {
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		resp, err := stun.Build(
+			stun.NewTransactionIDSetter(req.TransactionID),
+			stun.BindingSuccess,
+			&stun.XORMappedAddress{IP: udpAddr.IP, Port: udpAddr.Port},
+			stun.Fingerprint,
+		)
+		if err != nil {
+			continue
+		}
+		s.stunConn.WriteTo(resp.Raw, addr)
+	}
+}
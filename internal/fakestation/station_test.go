@@ -0,0 +1,130 @@
+package fakestation
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pp "github.com/pires/go-proxyproto"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+)
+
+// startBridge starts an echo server behind a PROXY protocol listener. The
+// client addresses reported in the PROXY headers are sent on clients.
+func startBridge(t *testing.T, clients chan<- net.Addr) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppln := &pp.Listener{Listener: ln, ReadHeaderTimeout: time.Second}
+	t.Cleanup(func() { ppln.Close() })
+	go func() {
+		for {
+			conn, err := ppln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// RemoteAddr reads the PROXY header
+				clients <- conn.RemoteAddr()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestStation(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config func(s *Station) *conjure.ConjureConfig
+	}{
+		{
+			name: "bdapi",
+			config: func(s *Station) *conjure.ConjureConfig {
+				return &conjure.ConjureConfig{
+					Registrars:  []string{"bdapi"},
+					RegisterURL: s.URL,
+				}
+			},
+		},
+		{
+			name: "ampcache",
+			config: func(s *Station) *conjure.ConjureConfig {
+				// The station stands in for both the cache and the origin,
+				// so front the cache requests to it
+				return &conjure.ConjureConfig{
+					Registrars:  []string{"ampcache"},
+					RegisterURL: "http://registration.example",
+					AMPCacheURL: "http://cache.example",
+					Fronts:      []string{s.URL[len("http://"):]},
+					STUNAddr:    s.STUNAddr,
+				}
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clients := make(chan net.Addr, 1)
+			station, err := Start(startBridge(t, clients))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer station.Close()
+
+			config := test.config(station)
+			config.Transport = "min"
+			config.BridgeAddress = "192.0.2.1:80"
+			conn, err := conjure.Register(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			msg := []byte("hello")
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, msg) {
+				t.Errorf("expected %q, got %q", msg, buf)
+			}
+
+			client := <-clients
+			if client.String() != conn.LocalAddr().String() {
+				t.Errorf("expected PROXY header with client %v, got %v", conn.LocalAddr(), client)
+			}
+			if n := station.Registrations(); n != 1 {
+				t.Errorf("expected 1 registration, got %d", n)
+			}
+		})
+	}
+}
+
+func TestStationUnregistered(t *testing.T) {
+	clients := make(chan net.Addr, 1)
+	station, err := Start(startBridge(t, clients))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	conn, err := net.Dial("tcp", station.PhantomAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(make([]byte, minTransportTagLen)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the station to close an unregistered connection, got %v", err)
+	}
+}
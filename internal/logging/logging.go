@@ -0,0 +1,165 @@
+// Package logging sets up the logs of the client and the bridge.
+//
+// Logs are written either as text, one log.Printf message per line, or as
+// JSON lines for ingestion into analysis tools. Every JSON record has the
+// fields "timestamp" (RFC 3339, UTC), "level", "component" and "msg".
+// Records about the progress of a connection add "session", "phase",
+// "registrar", "transport" and "error" where they apply. The tapdance
+// library's logrus logger is switched to the same format, with the
+// component "tapdance".
+//
+// Unless logs are unsafe, addresses are scrubbed with safelog in both
+// formats. JSON values are scrubbed before they are encoded.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Options describe how logs are written
+type Options struct {
+	// Format is FormatText or FormatJSON. Empty means FormatText.
+	Format string
+	// Component names the program in JSON records, e.g. "client"
+	Component string
+	// Unsafe turns off scrubbing
+	Unsafe bool
+}
+
+// Validate checks the format
+func (o Options) Validate() error {
+	switch o.Format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q, must be text or json", o.Format)
+}
+
+// Setup sends the standard log and slog output to out, in the format given
+// in opts
+func Setup(out io.Writer, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Format != FormatJSON {
+		if !opts.Unsafe {
+			out = &safelog.LogScrubber{Output: out}
+		}
+		log.SetFlags(log.LstdFlags | log.LUTC)
+		log.SetOutput(out)
+		return nil
+	}
+	handler := slog.NewJSONHandler(out, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 {
+				switch a.Key {
+				case slog.TimeKey:
+					a.Key = "timestamp"
+					a.Value = slog.TimeValue(a.Value.Time().UTC())
+					return a
+				case slog.LevelKey:
+					a.Value = slog.StringValue(levelName(a.Value.Any().(slog.Level)))
+					return a
+				}
+			}
+			if opts.Unsafe {
+				return a
+			}
+			switch a.Value.Kind() {
+			case slog.KindString:
+				a.Value = slog.StringValue(scrub(a.Value.String()))
+			case slog.KindAny:
+				if err, ok := a.Value.Any().(error); ok {
+					a.Value = slog.StringValue(scrub(err.Error()))
+				}
+			}
+			return a
+		},
+	})
+	// Also redirects the standard log package to the handler
+	slog.SetDefault(slog.New(handler).With("component", opts.Component))
+	return nil
+}
+
+// SetupLogrus sends the output of a library's logrus logger to out, in the
+// format given in opts. In JSON records, component replaces the one in opts.
+func SetupLogrus(logger *logrus.Logger, out io.Writer, component string, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Format != FormatJSON {
+		if !opts.Unsafe {
+			out = &safelog.LogScrubber{Output: out}
+		}
+		logger.SetOutput(out)
+		return nil
+	}
+	logger.SetFormatter(&logrus.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime: "timestamp",
+			logrus.FieldKeyMsg:  "msg",
+		},
+	})
+	logger.AddHook(&logrusHook{component: component, unsafe: opts.Unsafe})
+	logger.SetOutput(out)
+	return nil
+}
+
+// logrusHook makes logrus entries match slog's records
+type logrusHook struct {
+	component string
+	unsafe    bool
+}
+
+func (h *logrusHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *logrusHook) Fire(entry *logrus.Entry) error {
+	entry.Time = entry.Time.UTC()
+	entry.Data["component"] = h.component
+	if h.unsafe {
+		return nil
+	}
+	entry.Message = scrub(entry.Message)
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = scrub(v)
+		case error:
+			entry.Data[k] = scrub(v.Error())
+		}
+	}
+	return nil
+}
+
+// levelName spells slog levels the way logrus does
+func levelName(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "debug"
+	case level < slog.LevelWarn:
+		return "info"
+	case level < slog.LevelError:
+		return "warning"
+	}
+	return "error"
+}
+
+func scrub(s string) string {
+	return string(safelog.Scrub([]byte(s)))
+}
@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// restoreDefaults puts the standard and slog loggers back the way they were
+// before Setup
+func restoreDefaults(t *testing.T) {
+	defaultLogger := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+}
+
+// decodeLines parses each line of buf as a JSON object
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%q is not JSON: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestSetupJSON(t *testing.T) {
+	restoreDefaults(t)
+	for _, unsafe := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := Setup(&buf, Options{Format: FormatJSON, Component: "client", Unsafe: unsafe}); err != nil {
+			t.Fatal(err)
+		}
+		log.Printf("Connecting to 192.0.2.1:80")
+		slog.With("session", 3).Info("Connection status", "phase", "failed", "error", errors.New("dial 192.0.2.7:443: refused"))
+
+		records := decodeLines(t, &buf)
+		if len(records) != 2 {
+			t.Fatalf("expected 2 records, got %d", len(records))
+		}
+		for _, record := range records {
+			if record["component"] != "client" || record["level"] != "info" {
+				t.Errorf("expected the component and level in %v", record)
+			}
+			timestamp, err := time.Parse(time.RFC3339Nano, record["timestamp"].(string))
+			if err != nil || timestamp.Location() != time.UTC {
+				t.Errorf("expected a UTC timestamp in %v", record)
+			}
+		}
+		expected := []map[string]any{
+			{"msg": "Connecting to [scrubbed]"},
+			{"session": 3.0, "phase": "failed", "error": "dial [scrubbed]: refused"},
+		}
+		if unsafe {
+			expected[0]["msg"] = "Connecting to 192.0.2.1:80"
+			expected[1]["error"] = "dial 192.0.2.7:443: refused"
+		}
+		for i, fields := range expected {
+			for k, v := range fields {
+				if records[i][k] != v {
+					t.Errorf("expected %s to be %v in %v", k, v, records[i])
+				}
+			}
+		}
+	}
+}
+
+func TestSetupText(t *testing.T) {
+	restoreDefaults(t)
+	var buf bytes.Buffer
+	if err := Setup(&buf, Options{Format: FormatText}); err != nil {
+		t.Fatal(err)
+	}
+	log.Printf("Connecting to 192.0.2.1:80")
+	if !strings.HasSuffix(buf.String(), " Connecting to [scrubbed]\n") {
+		t.Errorf("expected a scrubbed text line, got %q", buf.String())
+	}
+}
+
+func TestSetupLogrus(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	if err := SetupLogrus(logger, &buf, "tapdance", Options{Format: FormatJSON, Component: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	logger.WithField("phantom", "192.0.2.7:443").Warnf("failed to dial phantom 192.0.2.7:443")
+
+	records := decodeLines(t, &buf)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	for k, v := range map[string]any{
+		"component": "tapdance",
+		"level":     "warning",
+		"msg":       "failed to dial phantom [scrubbed]",
+		"phantom":   "[scrubbed]",
+	} {
+		if records[0][k] != v {
+			t.Errorf("expected %s to be %v in %v", k, v, records[0])
+		}
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, records[0]["timestamp"].(string))
+	if err != nil || timestamp.Location() != time.UTC {
+		t.Errorf("expected a UTC timestamp in %v", records[0])
+	}
+}
+
+func TestInvalidFormat(t *testing.T) {
+	if err := Setup(&bytes.Buffer{}, Options{Format: "xml"}); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,128 @@
+// Package session holds the parts of the session layer that are shared by
+// the client and the bridge.
+//
+// The session layer lets a client keep one reliable stream to the bridge
+// open across several phantom connections. It works like Snowflake's turbo
+// tunnel: a KCP connection carries an smux session, and the KCP packets are
+// sent over a sequence of short-lived carrier connections through phantoms.
+// Each carrier connection starts with Token and the client's 8-byte ClientID,
+// followed by packets framed with the snowflake encapsulation package. The
+// bridge uses the ClientID to join packets from different carriers to the
+// same KCP connection.
+package session
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/encapsulation"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/turbotunnel"
+)
+
+// Token is sent at the start of a carrier connection to opt into the
+// session layer. It can't be confused with the start of a TLS connection.
+var Token = turbotunnel.Token
+
+// IdleTimeout is how long a carrier connection may go without receiving a
+// packet before it is considered stale. Both ends send smux keep-alives more
+// often than this.
+const IdleTimeout = 30 * time.Second
+
+// KeepAliveTimeout is how long a session survives without any carrier
+// connection, giving the client time to register a new phantom
+const KeepAliveTimeout = 10 * time.Minute
+
+const (
+	// Maximum KCP send and receive windows, in packets
+	windowSize = 65535
+	// Maximum smux stream buffer, in bytes
+	streamSize = 1048576
+)
+
+var errNotImplemented = errors.New("not implemented")
+
+// ConfigureKCP applies the settings used by both ends to a KCP connection
+func ConfigureKCP(conn *kcp.UDPSession) {
+	// Permit coalescing the payloads of consecutive sends.
+	conn.SetStreamMode(true)
+	// Set the maximum send and receive window sizes to a high number
+	conn.SetWindowSize(windowSize, windowSize)
+	// Disable the dynamic congestion window (limit only by the
+	// maximum of local and remote static windows).
+	conn.SetNoDelay(
+		0, // default nodelay
+		0, // default interval
+		0, // default resend
+		1, // nc=1 => congestion window off
+	)
+}
+
+// SmuxConfig returns the smux settings used by both ends
+func SmuxConfig() *smux.Config {
+	config := smux.DefaultConfig()
+	config.Version = 2
+	config.KeepAliveTimeout = KeepAliveTimeout
+	config.MaxStreamBuffer = streamSize
+	return config
+}
+
+// PacketConn is a net.PacketConn over a carrier connection, with packets
+// framed by the encapsulation package. Reads fail once no packet has
+// arrived for IdleTimeout.
+type PacketConn struct {
+	conn       net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	bw         *bufio.Writer
+}
+
+// NewPacketConn makes a PacketConn out of a carrier connection. The
+// addresses are reported in place of those of conn.
+func NewPacketConn(localAddr, remoteAddr net.Addr, conn net.Conn) *PacketConn {
+	return &PacketConn{
+		conn:       conn,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		bw:         bufio.NewWriter(conn),
+	}
+}
+
+// ReadFrom reads an encapsulated packet from the carrier
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(IdleTimeout)); err != nil {
+		return 0, c.remoteAddr, err
+	}
+	n, err := encapsulation.ReadData(c.conn, p)
+	if err == io.ErrShortBuffer {
+		err = nil
+	}
+	return n, c.remoteAddr, err
+}
+
+// WriteTo writes an encapsulated packet to the carrier. addr is ignored.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	_, err := encapsulation.WriteData(c.bw, p)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the carrier connection
+func (c *PacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *PacketConn) LocalAddr() net.Addr { return c.localAddr }
+
+func (c *PacketConn) SetDeadline(t time.Time) error      { return errNotImplemented }
+func (c *PacketConn) SetReadDeadline(t time.Time) error  { return errNotImplemented }
+func (c *PacketConn) SetWriteDeadline(t time.Time) error { return errNotImplemented }
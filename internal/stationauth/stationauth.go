@@ -0,0 +1,194 @@
+// Package stationauth authenticates the PROXY protocol headers that Conjure
+// stations send to the bridge.
+//
+// Each station shares a secret key with the bridge. The station adds a TLV
+// of type TLVType to the PROXY v2 header of every connection it forwards,
+// with the value
+//
+//	version (1 byte, 1) | name length (1 byte) | station name |
+//	timestamp (8 bytes, big-endian Unix seconds) | MAC (32 bytes)
+//
+// where the MAC is HMAC-SHA256, keyed with the station's key, over
+//
+//	"conjure station auth v1" | version | name length | station name |
+//	timestamp | source IP (16 bytes) | source port (2 bytes) |
+//	destination IP (16 bytes) | destination port (2 bytes)
+//
+// IPv4 addresses are written in their IPv4-mapped IPv6 form, and ports are
+// big-endian. The bridge only uses the client address in a header whose MAC
+// matches the key of the named station and whose timestamp is within
+// MaxClockSkew of its own clock.
+package stationauth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	pp "github.com/pires/go-proxyproto"
+)
+
+// TLVType is the PROXY v2 TLV type that carries the authenticator
+const TLVType = pp.PP2_TYPE_MIN_CUSTOM
+
+// MaxClockSkew is how far the timestamp of a header may be from the
+// bridge's clock
+const MaxClockSkew = 2 * time.Minute
+
+// MinKeyLen is the minimum length of a station key in bytes
+const MinKeyLen = 16
+
+const (
+	version    = 1
+	macLen     = sha256.Size
+	macContext = "conjure station auth v1"
+)
+
+var (
+	ErrMissingAuth  = errors.New("PROXY header is not authenticated")
+	ErrUnknownName  = errors.New("unknown station")
+	ErrBadMAC       = errors.New("PROXY header authenticator does not match")
+	ErrExpiredStamp = errors.New("PROXY header timestamp is too far from the current time")
+)
+
+// Keys maps station names to their keys
+type Keys map[string][]byte
+
+// LoadKeys reads station keys from a file. Each line holds a station name
+// and its hex-encoded key, separated by whitespace. Empty lines and lines
+// starting with # are ignored.
+func LoadKeys(filename string) (Keys, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(Keys)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a station name and a key", filename, n)
+		}
+		name := fields[0]
+		if len(name) > 255 {
+			return nil, fmt.Errorf("%s:%d: station name is too long", filename, n)
+		}
+		if _, ok := keys[name]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate station %q", filename, n, name)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key for station %q: %v", filename, n, name, err)
+		}
+		if len(key) < MinKeyLen {
+			return nil, fmt.Errorf("%s:%d: key for station %q is shorter than %d bytes", filename, n, name, MinKeyLen)
+		}
+		keys[name] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Sign adds an authenticator for the named station to header, replacing
+// any TLVs it had. The header is converted to version 2, which is the only
+// version that carries TLVs.
+func Sign(header *pp.Header, name string, key []byte, now time.Time) error {
+	if len(name) > 255 {
+		return errors.New("station name is too long")
+	}
+	header.Version = 2
+	prefix := make([]byte, 0, 2+len(name)+8)
+	prefix = append(prefix, version, byte(len(name)))
+	prefix = append(prefix, name...)
+	prefix = binary.BigEndian.AppendUint64(prefix, uint64(now.Unix()))
+
+	mac, err := computeMAC(header, key, prefix)
+	if err != nil {
+		return err
+	}
+	return header.SetTLVs([]pp.TLV{{Type: TLVType, Value: append(prefix, mac...)}})
+}
+
+// Verify checks the authenticator in header against keys, and returns the
+// name of the station that signed it.
+func Verify(header *pp.Header, keys Keys, now time.Time) (string, error) {
+	tlvs, err := header.TLVs()
+	if err != nil {
+		return "", err
+	}
+	var value []byte
+	for _, tlv := range tlvs {
+		if tlv.Type == TLVType {
+			value = tlv.Value
+			break
+		}
+	}
+	if value == nil {
+		return "", ErrMissingAuth
+	}
+
+	if len(value) < 2 || value[0] != version {
+		return "", errors.New("unsupported PROXY header authenticator")
+	}
+	nameLen := int(value[1])
+	if len(value) != 2+nameLen+8+macLen {
+		return "", errors.New("malformed PROXY header authenticator")
+	}
+	prefix := value[:2+nameLen+8]
+	name := string(value[2 : 2+nameLen])
+	stamp := time.Unix(int64(binary.BigEndian.Uint64(value[2+nameLen:])), 0)
+
+	key, ok := keys[name]
+	if !ok {
+		return name, fmt.Errorf("%w %q", ErrUnknownName, name)
+	}
+	mac, err := computeMAC(header, key, prefix)
+	if err != nil {
+		return name, err
+	}
+	if !hmac.Equal(mac, value[len(prefix):]) {
+		return name, ErrBadMAC
+	}
+	if skew := now.Sub(stamp); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return name, ErrExpiredStamp
+	}
+	return name, nil
+}
+
+func computeMAC(header *pp.Header, key []byte, prefix []byte) ([]byte, error) {
+	src, dst, ok := header.TCPAddrs()
+	if !ok {
+		return nil, errors.New("PROXY header does not carry TCP addresses")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(macContext)
+	buf.Write(prefix)
+	writeAddr(&buf, src)
+	writeAddr(&buf, dst)
+
+	h := hmac.New(sha256.New, key)
+	h.Write(buf.Bytes())
+	return h.Sum(nil), nil
+}
+
+func writeAddr(buf *bytes.Buffer, addr *net.TCPAddr) {
+	buf.Write(addr.IP.To16())
+	binary.Write(buf, binary.BigEndian, uint16(addr.Port))
+}
@@ -0,0 +1,124 @@
+package stationauth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pp "github.com/pires/go-proxyproto"
+)
+
+var testKeys = Keys{
+	"station1": bytes.Repeat([]byte{1}, 32),
+	"station2": bytes.Repeat([]byte{2}, 32),
+}
+
+func newHeader(client string) *pp.Header {
+	src, _ := net.ResolveTCPAddr("tcp", client)
+	dst, _ := net.ResolveTCPAddr("tcp", "198.51.100.1:443")
+	return pp.HeaderProxyFromAddrs(1, src, dst)
+}
+
+// roundTrip serializes and parses header, as the bridge would receive it
+func roundTrip(t *testing.T, header *pp.Header) *pp.Header {
+	var buf bytes.Buffer
+	if _, err := header.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := pp.Read(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Now()
+	for _, client := range []string{"192.0.2.1:1234", "[2001:db8::1]:1234"} {
+		header := newHeader(client)
+		if err := Sign(header, "station1", testKeys["station1"], now); err != nil {
+			t.Fatal(err)
+		}
+		name, err := Verify(roundTrip(t, header), testKeys, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "station1" {
+			t.Errorf("expected station1, got %s", name)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	now := time.Now()
+	sign := func(name string, key []byte, stamp time.Time) *pp.Header {
+		header := newHeader("192.0.2.1:1234")
+		if err := Sign(header, name, key, stamp); err != nil {
+			t.Fatal(err)
+		}
+		return header
+	}
+
+	unsigned := newHeader("192.0.2.1:1234")
+	unsigned.Version = 2
+
+	spoofed := sign("station1", testKeys["station1"], now)
+	spoofed.SourceAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+
+	for _, test := range []struct {
+		name   string
+		header *pp.Header
+		err    error
+	}{
+		{"unsigned", unsigned, ErrMissingAuth},
+		{"unknown station", sign("station3", testKeys["station1"], now), ErrUnknownName},
+		{"wrong key", sign("station2", testKeys["station1"], now), ErrBadMAC},
+		{"spoofed client", spoofed, ErrBadMAC},
+		{"old", sign("station1", testKeys["station1"], now.Add(-MaxClockSkew-time.Second)), ErrExpiredStamp},
+		{"future", sign("station1", testKeys["station1"], now.Add(MaxClockSkew+time.Second)), ErrExpiredStamp},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Verify(roundTrip(t, test.header), testKeys, now)
+			if !errors.Is(err, test.err) {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	write := func(contents string) string {
+		filename := filepath.Join(dir, "keys")
+		if err := os.WriteFile(filename, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	keys, err := LoadKeys(write("# stations\nstation1 " +
+		"0101010101010101010101010101010101010101010101010101010101010101\n\n" +
+		"station2\t0202020202020202020202020202020202020202020202020202020202020202\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !bytes.Equal(keys["station1"], testKeys["station1"]) || !bytes.Equal(keys["station2"], testKeys["station2"]) {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	for _, contents := range []string{
+		"station1\n",
+		"station1 nothex\n",
+		"station1 0101\n",
+		"station1 01010101010101010101010101010101\nstation1 01010101010101010101010101010101\n",
+	} {
+		if _, err := LoadKeys(write(contents)); err == nil {
+			t.Errorf("expected %q to be rejected", contents)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	pp "github.com/pires/go-proxyproto"
+)
+
+// anyStation is the allowlist entry that accepts connections from any
+// address
+const anyStation = "any"
+
+// stationAllowlist holds the addresses of the Conjure stations this bridge
+// accepts connections from. Entries are IP addresses or CIDR ranges, given
+// on the command line, in a file, or both. The file is read again by Reload,
+// which only affects connections accepted after it returns.
+//
+// An allowlist must have at least one entry. The entry "any" accepts
+// connections, and their PROXY headers, from any address, which lets anyone
+// who can reach the bridge claim any client address.
+type stationAllowlist struct {
+	entries  []string // entries given on the command line
+	filename string   // file with more entries, one per line
+
+	state atomic.Pointer[allowlistState]
+}
+
+type allowlistState struct {
+	nets []*net.IPNet
+	any  bool
+}
+
+func newStationAllowlist(commas string, filename string) (*stationAllowlist, error) {
+	a := &stationAllowlist{filename: filename}
+	for _, entry := range strings.Split(commas, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			a.entries = append(a.entries, entry)
+		}
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload rebuilds the allowlist from the command line entries and the
+// current contents of the allowlist file. If there is an error, including
+// an allowlist left without entries, the previous allowlist stays in place.
+func (a *stationAllowlist) Reload() error {
+	entries := a.entries
+	if a.filename != "" {
+		fileEntries, err := readAllowlistFile(a.filename)
+		if err != nil {
+			return err
+		}
+		entries = append(entries[:len(entries):len(entries)], fileEntries...)
+	}
+
+	state := &allowlistState{nets: make([]*net.IPNet, 0, len(entries))}
+	for _, entry := range entries {
+		if strings.EqualFold(entry, anyStation) {
+			state.any = true
+			continue
+		}
+		ipNet, err := parseStation(entry)
+		if err != nil {
+			return err
+		}
+		state.nets = append(state.nets, ipNet)
+	}
+	if len(state.nets) == 0 && !state.any {
+		return fmt.Errorf("no allowed stations are set, use -allowed-stations %s to accept PROXY headers from any address", anyStation)
+	}
+	a.state.Store(state)
+
+	if state.any {
+		log.Printf("Warning: accepting connections, and their PROXY headers, from any address")
+	} else {
+		log.Printf("Accepting connections from %d allowed station ranges", len(state.nets))
+	}
+	return nil
+}
+
+// Allowed reports whether ip belongs to an allowed station
+func (a *stationAllowlist) Allowed(ip net.IP) bool {
+	state := a.state.Load()
+	return state.any || state.contains(ip)
+}
+
+func (s *allowlistState) contains(ip net.IP) bool {
+	for _, ipNet := range s.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy is a pp.PolicyFunc that uses the PROXY header of connections from
+// allowed stations and drops all other connections.
+func (a *stationAllowlist) Policy(upstream net.Addr) (pp.Policy, error) {
+	host, _, err := net.SplitHostPort(upstream.String())
+	if err != nil {
+		return pp.REJECT, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !a.Allowed(ip) {
+		log.Printf("Dropping connection from %s, which is not an allowed station", upstream.String())
+		metrics.Rejected(otherStations, rejectNotAllowed)
+		return pp.REJECT, pp.ErrInvalidUpstream
+	}
+	return pp.USE, nil
+}
+
+// StationLabel returns the metrics label for the station a connection came
+// from. Addresses that are only allowed by the "any" entry are counted
+// under one label, so that they can't create a label each.
+func (a *stationAllowlist) StationLabel(addr net.Addr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "unknown"
+	}
+	if ip := net.ParseIP(host); ip == nil || !a.state.Load().contains(ip) {
+		return otherStations
+	}
+	return host
+}
+
+// readAllowlistFile reads allowlist entries from a file. Entries are
+// separated by newlines or commas, and # starts a comment.
+func readAllowlistFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", filename, err)
+	}
+	return entries, nil
+}
+
+// parseStation parses an IP address or CIDR range. A single address is
+// returned as a range that contains only that address.
+func parseStation(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid station range %q", entry)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid station address %q", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pp "github.com/pires/go-proxyproto"
+)
+
+func TestStationAllowlist(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		commas   string
+		file     string
+		allowed  []string
+		rejected []string
+	}{
+		{
+			name:     "addresses",
+			commas:   "192.0.2.1, 2001:db8::1",
+			allowed:  []string{"192.0.2.1", "2001:db8::1"},
+			rejected: []string{"192.0.2.2", "2001:db8::2"},
+		},
+		{
+			name:     "ranges",
+			commas:   "192.0.2.0/24,2001:db8::/32",
+			allowed:  []string{"192.0.2.1", "192.0.2.255", "2001:db8:1::1"},
+			rejected: []string{"198.51.100.1", "2001:db9::1"},
+		},
+		{
+			name:     "file",
+			commas:   "192.0.2.1",
+			file:     "# stations\n198.51.100.0/24\n\n203.0.113.1, 203.0.113.2 # more\n",
+			allowed:  []string{"192.0.2.1", "198.51.100.7", "203.0.113.2"},
+			rejected: []string{"192.0.2.2", "203.0.113.3"},
+		},
+		{
+			name:    "any",
+			commas:  "any",
+			allowed: []string{"192.0.2.1", "2001:db8::1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var filename string
+			if test.file != "" {
+				filename = filepath.Join(t.TempDir(), "allowlist")
+				if err := os.WriteFile(filename, []byte(test.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a, err := newStationAllowlist(test.commas, filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range test.allowed {
+				if !a.Allowed(net.ParseIP(ip)) {
+					t.Errorf("expected %s to be allowed", ip)
+				}
+			}
+			for _, ip := range test.rejected {
+				if a.Allowed(net.ParseIP(ip)) {
+					t.Errorf("expected %s to be rejected", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestStationAllowlistInvalid(t *testing.T) {
+	// An empty allowlist would trust PROXY headers from anyone
+	for _, commas := range []string{"", " , ", "192.0.2", "192.0.2.0/33", "station.example"} {
+		if _, err := newStationAllowlist(commas, ""); err == nil {
+			t.Errorf("expected %q to be rejected", commas)
+		}
+	}
+	if _, err := newStationAllowlist("", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected a missing allowlist file to be an error")
+	}
+}
+
+func TestStationAllowlistReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "allowlist")
+	if err := os.WriteFile(filename, []byte("192.0.2.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newStationAllowlist("", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filename, []byte("198.51.100.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Allowed(net.ParseIP("192.0.2.1")) || !a.Allowed(net.ParseIP("198.51.100.1")) {
+		t.Error("reload did not replace the allowlist")
+	}
+
+	// A bad file keeps the previous list
+	if err := os.WriteFile(filename, []byte("not an address\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err == nil {
+		t.Error("expected reloading a bad file to fail")
+	}
+	if !a.Allowed(net.ParseIP("198.51.100.1")) {
+		t.Error("failed reload changed the allowlist")
+	}
+
+	// So does a file that was emptied
+	if err := os.WriteFile(filename, []byte("# no stations\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err == nil {
+		t.Error("expected reloading an empty allowlist to fail")
+	}
+	if !a.Allowed(net.ParseIP("198.51.100.1")) || a.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Error("failed reload changed the allowlist")
+	}
+}
+
+func TestStationAllowlistPolicy(t *testing.T) {
+	a, err := newStationAllowlist("192.0.2.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := a.Policy(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234})
+	if err != nil || policy != pp.USE {
+		t.Errorf("expected allowed station to use PROXY header, got %v %v", policy, err)
+	}
+	_, err = a.Policy(&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234})
+	if !errors.Is(err, pp.ErrInvalidUpstream) {
+		t.Errorf("expected other addresses to be dropped, got %v", err)
+	}
+}
+
+func TestStationLabel(t *testing.T) {
+	a, err := newStationAllowlist("192.0.2.0/24,any", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, label := range map[string]string{
+		"192.0.2.1:1234":    "192.0.2.1",
+		"198.51.100.1:1234": otherStations,
+		"198.51.100.2:1234": otherStations,
+	} {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := a.StationLabel(tcpAddr); l != label {
+			t.Errorf("expected label %q for %s, got %q", label, addr, l)
+		}
+	}
+	if l := a.StationLabel(nil); l != "unknown" {
+		t.Errorf("expected label unknown without an address, got %q", l)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	pp "github.com/pires/go-proxyproto"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/stationauth"
+)
+
+// stationAuthenticator checks that PROXY headers were signed by a station
+// that shares a key with this bridge, so that the client addresses in them
+// can be trusted. The keys are read from a file, and read again by Reload.
+type stationAuthenticator struct {
+	filename string
+	keys     atomic.Pointer[stationauth.Keys]
+}
+
+func newStationAuthenticator(filename string) (*stationAuthenticator, error) {
+	a := &stationAuthenticator{filename: filename}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the station keys file again. If there is an error, the
+// previous keys stay in place.
+func (a *stationAuthenticator) Reload() error {
+	keys, err := stationauth.LoadKeys(a.filename)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no station keys in %s", a.filename)
+	}
+	a.keys.Store(&keys)
+	log.Printf("Loaded keys for %d stations", len(keys))
+	return nil
+}
+
+// ValidateHeader is a pp.Validator that accepts only headers signed by one
+// of the stations
+func (a *stationAuthenticator) ValidateHeader(header *pp.Header) error {
+	name, err := stationauth.Verify(header, *a.keys.Load(), time.Now())
+	if err != nil {
+		if name != "" {
+			return fmt.Errorf("station %q: %w", name, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Policy wraps policy so that every connection it accepts must carry a
+// PROXY header, and so goes through ValidateHeader.
+func (a *stationAuthenticator) Policy(policy pp.PolicyFunc) pp.PolicyFunc {
+	return func(upstream net.Addr) (pp.Policy, error) {
+		p, err := policy(upstream)
+		if err != nil {
+			return p, err
+		}
+		if p == pp.USE {
+			p = pp.REQUIRE
+		}
+		return p, nil
+	}
+}
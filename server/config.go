@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/configfile"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/logging"
+)
+
+// Flags that can only be given on the command line
+var commandLineOnly = []string{"config", "validate-config"}
+
+// serverOptions are the options that checkConfig checks
+type serverOptions struct {
+	allowedStations     string
+	allowedStationsFile string
+	stationKeysFile     string
+	metricsAddr         string
+	listenAddr          string
+	upstreamAddr        string
+	upstreamProxyHeader string
+	logFormat           string
+}
+
+// checkConfig prints the effective configuration to w as TOML, and checks
+// it, including the allowed stations and station keys files, without
+// starting the bridge
+func checkConfig(w io.Writer, opts serverOptions) error {
+	if err := configfile.Print(w, flag.CommandLine, nil, commandLineOnly...); err != nil {
+		return err
+	}
+
+	var errs []error
+	if err := (logging.Options{Format: opts.logFormat}).Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.upstreamAddr == "" {
+		if opts.listenAddr != "" || opts.upstreamProxyHeader != "none" {
+			errs = append(errs, errors.New("listen and upstream-proxy-header can only be used with upstream"))
+		}
+	} else {
+		if opts.listenAddr == "" {
+			errs = append(errs, errors.New("upstream requires listen"))
+		} else if _, err := net.ResolveTCPAddr("tcp", opts.listenAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid listen address: %v", err))
+		}
+		if _, err := parseProxyHeaderVersion(opts.upstreamProxyHeader); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.metricsAddr != "" {
+		if err := checkMetricsAddr(opts.metricsAddr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := newStationAllowlist(opts.allowedStations, opts.allowedStationsFile); err != nil {
+		errs = append(errs, fmt.Errorf("invalid allowed stations: %v", err))
+	}
+	if opts.stationKeysFile != "" {
+		if _, err := newStationAuthenticator(opts.stationKeysFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid station keys: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	valid := serverOptions{allowedStations: "192.0.2.0/24", upstreamProxyHeader: "none", logFormat: "text"}
+	upstream := valid
+	upstream.upstreamAddr = "127.0.0.1:8000"
+	upstream.listenAddr = "127.0.0.1:8080"
+	upstream.upstreamProxyHeader = "v2"
+
+	for _, test := range []struct {
+		name   string
+		modify func(*serverOptions)
+		errs   []string
+	}{
+		{name: "managed"},
+		{name: "upstream", modify: func(o *serverOptions) { *o = upstream }},
+		{
+			name: "listen without upstream",
+			modify: func(o *serverOptions) {
+				o.listenAddr = "127.0.0.1:8080"
+			},
+			errs: []string{"can only be used with upstream"},
+		},
+		{
+			name: "upstream without listen",
+			modify: func(o *serverOptions) {
+				*o = upstream
+				o.listenAddr = ""
+				o.upstreamProxyHeader = "v3"
+			},
+			errs: []string{"upstream requires listen", `unknown PROXY header version "v3"`},
+		},
+		{
+			name:   "no allowed stations",
+			modify: func(o *serverOptions) { o.allowedStations = "" },
+			errs:   []string{"no allowed stations are set"},
+		},
+		{name: "any station", modify: func(o *serverOptions) { o.allowedStations = "any" }},
+		{
+			name: "files and addresses",
+			modify: func(o *serverOptions) {
+				o.allowedStations = "192.0.2.0/33"
+				o.stationKeysFile = missing
+				o.metricsAddr = "0.0.0.0:9100"
+				o.logFormat = "xml"
+			},
+			errs: []string{"invalid allowed stations", "invalid station keys", "not a loopback address", "unknown log format"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := valid
+			if test.modify != nil {
+				test.modify(&opts)
+			}
+			err := checkConfig(io.Discard, opts)
+			if len(test.errs) == 0 && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			for _, e := range test.errs {
+				if err == nil || !strings.Contains(err.Error(), e) {
+					t.Errorf("expected an error containing %q, got %v", e, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons for rejecting a connection, used as the reason label
+const (
+	rejectNotAllowed    = "not_allowed"
+	rejectInvalidHeader = "invalid_header"
+)
+
+// otherStations is the station label of connections from addresses that
+// aren't listed as allowed stations. They are all counted under one label,
+// so that scans don't create a label per address.
+const otherStations = "other"
+
+// sessionDurationBuckets are the upper bounds of the session duration
+// histogram buckets, in seconds
+var sessionDurationBuckets = []float64{1, 10, 60, 300, 1800, 3600, 4 * 3600}
+
+// serverMetrics counts what the bridge does, for export in the Prometheus
+// text exposition format.
+type serverMetrics struct {
+	lock     sync.Mutex
+	accepted map[string]uint64    // by station address
+	rejected map[[2]string]uint64 // by station address and reason
+
+	activeSessions  atomic.Int64
+	bytesToOR       atomic.Uint64
+	bytesFromOR     atomic.Uint64
+	dialORFailures  atomic.Uint64
+	durationBuckets []uint64 // cumulative counts for sessionDurationBuckets
+	durationCount   uint64
+	durationSum     float64
+}
+
+var metrics = newServerMetrics()
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		accepted:        make(map[string]uint64),
+		rejected:        make(map[[2]string]uint64),
+		durationBuckets: make([]uint64, len(sessionDurationBuckets)),
+	}
+}
+
+func (m *serverMetrics) Accepted(station string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.accepted[station]++
+}
+
+func (m *serverMetrics) Rejected(station string, reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rejected[[2]string{station, reason}]++
+}
+
+func (m *serverMetrics) DialORFailed() {
+	m.dialORFailures.Add(1)
+}
+
+// SessionStarted records the start of a proxied session and returns a
+// function that records its end
+func (m *serverMetrics) SessionStarted() func() {
+	start := time.Now()
+	m.activeSessions.Add(1)
+	return func() {
+		m.activeSessions.Add(-1)
+		seconds := time.Since(start).Seconds()
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		for i, bound := range sessionDurationBuckets {
+			if seconds <= bound {
+				m.durationBuckets[i]++
+			}
+		}
+		m.durationCount++
+		m.durationSum += seconds
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *serverMetrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	m.lock.Lock()
+
+	b.WriteString("# HELP conjure_connections_accepted_total Connections accepted from each station.\n")
+	b.WriteString("# TYPE conjure_connections_accepted_total counter\n")
+	for _, station := range sortedKeys(m.accepted) {
+		fmt.Fprintf(&b, "conjure_connections_accepted_total{station=%s} %d\n",
+			strconv.Quote(station), m.accepted[station])
+	}
+
+	b.WriteString("# HELP conjure_connections_rejected_total Connections rejected from each station, by reason.\n")
+	b.WriteString("# TYPE conjure_connections_rejected_total counter\n")
+	rejected := make([][2]string, 0, len(m.rejected))
+	for key := range m.rejected {
+		rejected = append(rejected, key)
+	}
+	sort.Slice(rejected, func(i, j int) bool {
+		if rejected[i][0] != rejected[j][0] {
+			return rejected[i][0] < rejected[j][0]
+		}
+		return rejected[i][1] < rejected[j][1]
+	})
+	for _, key := range rejected {
+		fmt.Fprintf(&b, "conjure_connections_rejected_total{station=%s,reason=%s} %d\n",
+			strconv.Quote(key[0]), strconv.Quote(key[1]), m.rejected[key])
+	}
+
+	b.WriteString("# HELP conjure_session_duration_seconds Duration of proxied sessions.\n")
+	b.WriteString("# TYPE conjure_session_duration_seconds histogram\n")
+	for i, bound := range sessionDurationBuckets {
+		fmt.Fprintf(&b, "conjure_session_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.durationBuckets[i])
+	}
+	fmt.Fprintf(&b, "conjure_session_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(&b, "conjure_session_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(&b, "conjure_session_duration_seconds_count %d\n", m.durationCount)
+	m.lock.Unlock()
+
+	b.WriteString("# HELP conjure_sessions_active Sessions currently being proxied to the ORPort.\n")
+	b.WriteString("# TYPE conjure_sessions_active gauge\n")
+	fmt.Fprintf(&b, "conjure_sessions_active %d\n", m.activeSessions.Load())
+
+	b.WriteString("# HELP conjure_proxied_bytes_total Bytes proxied between clients and the ORPort.\n")
+	b.WriteString("# TYPE conjure_proxied_bytes_total counter\n")
+	fmt.Fprintf(&b, "conjure_proxied_bytes_total{direction=\"from_or\"} %d\n", m.bytesFromOR.Load())
+	fmt.Fprintf(&b, "conjure_proxied_bytes_total{direction=\"to_or\"} %d\n", m.bytesToOR.Load())
+
+	b.WriteString("# HELP conjure_dial_or_failures_total Failed attempts to connect to the ORPort.\n")
+	b.WriteString("# TYPE conjure_dial_or_failures_total counter\n")
+	fmt.Fprintf(&b, "conjure_dial_or_failures_total %d\n", m.dialORFailures.Load())
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countingWriter adds the number of bytes written through it to a counter
+type countingWriter struct {
+	w     io.Writer
+	count *atomic.Uint64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+// startMetricsServer serves the metrics on addr, which must be a loopback
+// address
+func startMetricsServer(addr string) (net.Listener, error) {
+	if err := checkMetricsAddr(addr); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error serving metrics: %s", err.Error())
+		}
+	}()
+	log.Printf("Serving metrics on http://%s/metrics", ln.Addr().String())
+	return ln, nil
+}
+
+// checkMetricsAddr checks that addr is a loopback address and port
+func checkMetricsAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		if host != "localhost" {
+			return fmt.Errorf("metrics address %s is not a loopback address", addr)
+		}
+	}
+	return nil
+}
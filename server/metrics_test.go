@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+)
+
+// resetMetrics clears the metrics before a test. Sessions left over from
+// earlier tests are still winding down, so it waits for them to end and
+// clears the metrics in place.
+func resetMetrics(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.activeSessions.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions from earlier tests did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	clear(metrics.accepted)
+	clear(metrics.rejected)
+	clear(metrics.durationBuckets)
+	metrics.durationCount = 0
+	metrics.durationSum = 0
+	metrics.bytesToOR.Store(0)
+	metrics.bytesFromOR.Store(0)
+	metrics.dialORFailures.Store(0)
+}
+
+// scrape fetches the metrics from the server at addr
+func scrape(t *testing.T, addr string) string {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// waitForMetric scrapes until the metrics contain line
+func waitForMetric(t *testing.T, addr string, line string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body := scrape(t, addr)
+		if strings.Contains(body, line+"\n") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics do not contain %q:\n%s", line, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	resetMetrics(t)
+	ln, err := startMetricsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	station, err := fakestation.Start(startServer(t, startEcho(t), "127.0.0.0/8", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	conn := connect(t, station)
+	if !echo(conn) {
+		t.Fatal("expected data to be echoed")
+	}
+	waitForMetric(t, addr, `conjure_connections_accepted_total{station="127.0.0.1"} 1`)
+	waitForMetric(t, addr, `conjure_sessions_active 1`)
+	waitForMetric(t, addr, `conjure_proxied_bytes_total{direction="to_or"} 25`)
+	waitForMetric(t, addr, `conjure_proxied_bytes_total{direction="from_or"} 25`)
+
+	conn.Close()
+	waitForMetric(t, addr, `conjure_sessions_active 0`)
+	waitForMetric(t, addr, `conjure_session_duration_seconds_count 1`)
+	waitForMetric(t, addr, `conjure_session_duration_seconds_bucket{le="+Inf"} 1`)
+
+	// An ORPort that refuses connections
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	refused, err := fakestation.Start(startServer(t, closed.Addr().(*net.TCPAddr), "127.0.0.0/8", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	echo(connect(t, refused))
+	waitForMetric(t, addr, `conjure_dial_or_failures_total 1`)
+	waitForMetric(t, addr, `conjure_connections_accepted_total{station="127.0.0.1"} 2`)
+}
+
+func TestMetricsRejected(t *testing.T) {
+	resetMetrics(t)
+	ln, err := startMetricsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	station, err := fakestation.Start(startServer(t, startEcho(t), "192.0.2.1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	echo(connect(t, station))
+	waitForMetric(t, ln.Addr().String(), `conjure_connections_rejected_total{station="other",reason="not_allowed"} 1`)
+}
+
+func TestMetricsLoopbackOnly(t *testing.T) {
+	if _, err := startMetricsServer("0.0.0.0:0"); err == nil {
+		t.Error("expected a non-loopback metrics address to be rejected")
+	}
+}
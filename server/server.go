@@ -2,22 +2,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	pp "github.com/pires/go-proxyproto"
 	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
-	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/ptutil/safelog"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/configfile"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/logging"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/session"
 )
 
 var ptInfo pt.ServerInfo
@@ -26,7 +31,7 @@ func proxy(or *net.TCPConn, conn net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
-		if _, err := io.Copy(conn, or); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		if _, err := io.Copy(&countingWriter{conn, &metrics.bytesFromOR}, or); err != nil && !errors.Is(err, io.ErrClosedPipe) {
 			log.Printf("Error copying OR to phantom %v", err)
 		}
 		or.CloseRead()
@@ -34,7 +39,7 @@ func proxy(or *net.TCPConn, conn net.Conn) {
 		wg.Done()
 	}()
 	go func() {
-		if _, err := io.Copy(or, conn); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		if _, err := io.Copy(&countingWriter{or, &metrics.bytesToOR}, conn); err != nil && !errors.Is(err, io.ErrClosedPipe) {
 			log.Printf("Error copying phantom to OR %v", err)
 		}
 		or.CloseWrite()
@@ -44,7 +49,53 @@ func proxy(or *net.TCPConn, conn net.Conn) {
 	wg.Wait()
 }
 
-func acceptLoop(ln net.Listener) {
+// peekedConn is a net.Conn whose first bytes were read into r to check
+// for the session Token
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// handleClient proxies a client connection, or a session stream, to the
+// upstream. addr is the client address reported to the upstream.
+func handleClient(dial dialUpstream, conn net.Conn, addr string) {
+	log.Printf("Received client connection from %s", addr)
+	or, err := dial(addr)
+	if err != nil {
+		log.Printf("Error dialing upstream: %v", err)
+		metrics.DialORFailed()
+		return
+	}
+	defer or.Close()
+	defer metrics.SessionStarted()()
+	proxy(or, conn)
+	log.Printf("Done proxying client connection from %s", addr)
+}
+
+// sessionTokenTimeout is how long a client has to send the session Token,
+// when sessions are enabled, before it is handled as a client that doesn't
+// use sessions
+const sessionTokenTimeout = 2 * time.Second
+
+// acceptLoop proxies the clients that connect to ln with dial. Clients that
+// use the session layer are only recognized if sessions is set, as looking
+// for their Token means waiting for the client to send something first.
+func acceptLoop(ln net.Listener, dial dialUpstream, stations *stationAllowlist, sessions bool) {
+	var sessionServer *sessionServer
+	if sessions {
+		var err error
+		sessionServer, err = newSessionServer(ln.Addr(), dial)
+		if err != nil {
+			log.Printf("Error starting session server: %s", err)
+			return
+		}
+		defer sessionServer.Close()
+	}
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -54,30 +105,110 @@ func acceptLoop(ln net.Listener) {
 			log.Printf("Error accepting conjure connection: %s", err)
 			break
 		}
-		log.Printf("Received client connection from %s", conn.RemoteAddr().String())
 		go func() {
 			defer conn.Close()
-			or, err := pt.DialOr(&ptInfo, conn.RemoteAddr().String(), "conjure")
-			if err != nil {
-				log.Printf("Error dialing OR port: %v", err)
+			station := stations.StationLabel(conn.RemoteAddr())
+			if c, ok := conn.(*pp.Conn); ok {
+				station = stations.StationLabel(c.Raw().RemoteAddr())
+				// Read the PROXY header now, so that a header that fails
+				// the listener's policy or validation drops the connection
+				// instead of reporting the station's address to Tor
+				if _, err := c.Read(nil); err != nil {
+					log.Printf("Dropping connection with invalid PROXY header: %s", err.Error())
+					metrics.Rejected(station, rejectInvalidHeader)
+					return
+				}
 			}
-			defer or.Close()
-			proxy(or, conn)
-			log.Printf("Done proxying client connection from %s", conn.RemoteAddr().String())
+			metrics.Accepted(station)
+
+			// The upstream may speak first, so without sessions nothing is
+			// read from the client before dialing it
+			if sessionServer == nil {
+				handleClient(dial, conn, conn.RemoteAddr().String())
+				return
+			}
+
+			// Clients that use the session layer start with the session
+			// Token, everyone else starts a TLS connection with tor
+			r := bufio.NewReader(conn)
+			conn.SetReadDeadline(time.Now().Add(sessionTokenTimeout))
+			token, err := r.Peek(len(session.Token))
+			conn.SetReadDeadline(time.Time{})
+			if err == nil && bytes.Equal(token, session.Token[:]) {
+				r.Discard(len(token))
+				if err := sessionServer.handleCarrier(conn, r); err != nil {
+					log.Printf("Error handling session connection: %s", err.Error())
+				}
+				return
+			}
+			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+			handleClient(dial, &peekedConn{Conn: conn, r: r}, conn.RemoteAddr().String())
 		}()
 	}
 }
 
 func main() {
 	var allowedStationsCommas string
+	var allowedStationsFile string
+	var stationKeysFile string
+	var metricsAddr string
+	var listenAddr string
+	var upstreamAddr string
+	var upstreamProxyHeader string
 	var logFilename string
 	var unsafeLogging bool
+	var logFormat string
+	var configFile string
+	var validateConfig bool
+	var sessions bool
 
-	flag.StringVar(&allowedStationsCommas, "allowed-stations", "", "comma-separated ip addresses of conjure stations this bridge will accept connections from")
+	flag.StringVar(&allowedStationsCommas, "allowed-stations", "", "comma-separated ip addresses or CIDR ranges of conjure stations this bridge will accept connections from, or any to trust PROXY headers from any address")
+	flag.StringVar(&allowedStationsFile, "allowed-stations-file", "", "file with more allowed station addresses or ranges, one per line, read again on SIGHUP")
+	flag.StringVar(&stationKeysFile, "station-keys", "", "file with the names and hex-encoded keys of stations, one per line; if set, connections must carry a PROXY header signed by one of them")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "loopback address and port to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9100")
+	flag.StringVar(&upstreamAddr, "upstream", "", "TCP address to proxy clients to instead of tor's ORPort, running without tor's managed proxy protocol")
+	flag.StringVar(&listenAddr, "listen", "", "address to listen for station connections on, required with -upstream")
+	flag.StringVar(&upstreamProxyHeader, "upstream-proxy-header", "none", "PROXY header to send to the upstream with the client address: none, v1 or v2")
+	flag.BoolVar(&sessions, "session", false, "accept clients that use the session layer, which must send their first bytes before the upstream is dialed")
 	flag.StringVar(&logFilename, "log", "", "name of the log file")
 	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "prevent logs from being scrubbed")
+	flag.StringVar(&logFormat, "log-format", logging.FormatText, "format of the log: text, or json for one JSON object per line")
+	flag.StringVar(&configFile, "config", "", "TOML (.toml) or JSON file of options named like these flags, which override the command line")
+	flag.BoolVar(&validateConfig, "validate-config", false, "print the effective configuration and check it, then exit")
 	flag.Parse()
 
+	if configFile != "" {
+		file, err := configfile.Load(configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(file.Bridges) > 0 || len(file.Methods) > 0 {
+			log.Fatalf("%s: the %s and %s tables are only read by the client", configFile, configfile.BridgesKey, configfile.MethodsKey)
+		}
+		if err := file.Apply(flag.CommandLine, commandLineOnly...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if validateConfig {
+		err := checkConfig(os.Stdout, serverOptions{
+			allowedStations:     allowedStationsCommas,
+			allowedStationsFile: allowedStationsFile,
+			stationKeysFile:     stationKeysFile,
+			metricsAddr:         metricsAddr,
+			listenAddr:          listenAddr,
+			upstreamAddr:        upstreamAddr,
+			upstreamProxyHeader: upstreamProxyHeader,
+			logFormat:           logFormat,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Set up logging
 	var logFile io.Writer
 	logFile = ioutil.Discard
@@ -89,27 +220,70 @@ func main() {
 		defer f.Close()
 		logFile = f
 	}
-	if !unsafeLogging {
-		logFile = &safelog.LogScrubber{Output: logFile}
+	logOpts := logging.Options{Format: logFormat, Component: "server", Unsafe: unsafeLogging}
+	if err := logging.Setup(logFile, logOpts); err != nil {
+		log.Fatal(err)
 	}
-	log.SetFlags(log.LstdFlags | log.LUTC)
-	log.SetOutput(logFile)
 
-	var err error
-	ptInfo, err = pt.ServerSetup(nil)
-	if err != nil {
-		log.Fatalf("Error in setup: %s", err)
+	// Without -upstream, tor tells us where to listen and runs the ORPort
+	// that clients are proxied to
+	managed := upstreamAddr == ""
+	var bindaddrs []pt.Bindaddr
+	var dial dialUpstream
+	if managed {
+		if listenAddr != "" || upstreamProxyHeader != "none" {
+			log.Fatalf("-listen and -upstream-proxy-header can only be used with -upstream")
+		}
+		var err error
+		ptInfo, err = pt.ServerSetup(nil)
+		if err != nil {
+			log.Fatalf("Error in setup: %s", err)
+		}
+		bindaddrs = ptInfo.Bindaddrs
+		dial = dialOR(&ptInfo)
+	} else {
+		if listenAddr == "" {
+			log.Fatalf("-upstream requires -listen")
+		}
+		addr, err := net.ResolveTCPAddr("tcp", listenAddr)
+		if err != nil {
+			log.Fatalf("Error resolving listen address: %s", err.Error())
+		}
+		headerVersion, err := parseProxyHeaderVersion(upstreamProxyHeader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bindaddrs = []pt.Bindaddr{{MethodName: "conjure", Addr: addr}}
+		dial = dialTCP(upstreamAddr, headerVersion)
+		log.Printf("Proxying clients to %s", upstreamAddr)
 	}
-	allowedStations := strings.Split(allowedStationsCommas, ",")
-
-	//TODO: if allowed stations are empty, don't set policy?
-	policy, err := pp.StrictWhiteListPolicy(allowedStations)
+	if metricsAddr != "" {
+		metricsListener, err := startMetricsServer(metricsAddr)
+		if err != nil {
+			log.Fatalf("Error starting metrics server: %s", err.Error())
+		}
+		defer metricsListener.Close()
+	}
+	allowedStations, err := newStationAllowlist(allowedStationsCommas, allowedStationsFile)
 	if err != nil {
-		log.Fatalf("Error setting haproxy policy: %s", err.Error())
+		log.Fatalf("Error setting allowed stations: %s", err.Error())
+	}
+	policy := allowedStations.Policy
+	var validateHeader pp.Validator
+	var stationAuth *stationAuthenticator
+	if stationKeysFile != "" {
+		stationAuth, err = newStationAuthenticator(stationKeysFile)
+		if err != nil {
+			log.Fatalf("Error loading station keys: %s", err.Error())
+		}
+		policy = stationAuth.Policy(policy)
+		validateHeader = stationAuth.ValidateHeader
+	} else {
+		log.Printf("Warning: no station keys are set, PROXY headers are not authenticated")
 	}
 
 	listeners := make([]net.Listener, 0)
-	for _, bindaddr := range ptInfo.Bindaddrs {
+	for _, bindaddr := range bindaddrs {
 		if bindaddr.MethodName != "conjure" {
 			pt.SmethodError(bindaddr.MethodName, "no such method")
 			continue
@@ -118,27 +292,55 @@ func main() {
 		ln, err := net.ListenTCP("tcp", bindaddr.Addr)
 		if err != nil {
 			log.Printf("Failed to bind to address: %v", err)
+			if !managed {
+				log.Fatal(err)
+			}
 			pt.SmethodError(bindaddr.MethodName, err.Error())
+			continue
 		}
 
 		haproxyListener := &pp.Listener{
 			Listener:          ln,
 			ReadHeaderTimeout: time.Second,
 			Policy:            policy,
+			ValidateHeader:    validateHeader,
 		}
 		defer haproxyListener.Close()
 		defer ln.Close()
 		listeners = append(listeners, haproxyListener)
-		go acceptLoop(haproxyListener)
-
-		pt.Smethod(bindaddr.MethodName, ln.Addr())
+		go acceptLoop(haproxyListener, dial, allowedStations, sessions)
 
+		if managed {
+			pt.Smethod(bindaddr.MethodName, ln.Addr())
+		} else {
+			log.Printf("Listening for station connections on %s", ln.Addr())
+		}
+	}
+	if managed {
+		pt.SmethodsDone()
 	}
-	pt.SmethodsDone()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM)
 
+	// Reload the allowed stations and station keys on SIGHUP. Connections that were already
+	// accepted are not affected.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Println("Reloading allowed stations")
+			if err := allowedStations.Reload(); err != nil {
+				log.Printf("Error reloading allowed stations, keeping the previous list: %s", err.Error())
+			}
+			if stationAuth != nil {
+				if err := stationAuth.Reload(); err != nil {
+					log.Printf("Error reloading station keys, keeping the previous keys: %s", err.Error())
+				}
+			}
+		}
+	}()
+
 	// https://gitweb.torproject.org/torspec.git/tree/pt-spec.txt#n203
 	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
 		go func() {
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pp "github.com/pires/go-proxyproto"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/client/conjure"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/stationauth"
+)
+
+// startEcho starts a TCP echo server standing in for the ORPort
+func startEcho(t *testing.T) *net.TCPAddr {
+	return startCountingEcho(t, nil)
+}
+
+// startCountingEcho starts an echo server that adds each connection it
+// accepts to accepted
+func startCountingEcho(t *testing.T, accepted *atomic.Int32) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if accepted != nil {
+				accepted.Add(1)
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// startServer runs the bridge's accept loop, proxying to the ORPort at
+// orAddr, behind a PROXY protocol listener that only accepts connections from
+// the allowed stations. If keys is set, the PROXY headers must be signed with
+// one of them.
+func startServer(t *testing.T, orAddr *net.TCPAddr, allowed string, keys stationauth.Keys) string {
+	return startUpstreamServer(t, dialOR(&pt.ServerInfo{OrAddr: orAddr}), allowed, keys, false)
+}
+
+// startUpstreamServer is like startServer, but proxies clients with dial,
+// and accepts session clients if sessions is set
+func startUpstreamServer(t *testing.T, dial dialUpstream, allowed string, keys stationauth.Keys, sessions bool) string {
+	allowedStations, err := newStationAllowlist(allowed, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	haproxyListener := &pp.Listener{
+		Listener:          ln,
+		ReadHeaderTimeout: time.Second,
+		Policy:            allowedStations.Policy,
+	}
+	if keys != nil {
+		auth := &stationAuthenticator{}
+		auth.keys.Store(&keys)
+		haproxyListener.Policy = auth.Policy(haproxyListener.Policy)
+		haproxyListener.ValidateHeader = auth.ValidateHeader
+	}
+	t.Cleanup(func() { haproxyListener.Close() })
+	go acceptLoop(haproxyListener, dial, allowedStations, sessions)
+	return ln.Addr().String()
+}
+
+// connect registers with station and connects to the bridge through it
+func connect(t *testing.T, station *fakestation.Station) net.Conn {
+	conn, err := conjure.Register(&conjure.ConjureConfig{
+		Registrars:    []string{"bdapi"},
+		RegisterURL:   station.URL,
+		Transport:     "min",
+		BridgeAddress: "192.0.2.1:80",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// echo reports whether data sent on conn is echoed back by the ORPort
+func echo(conn net.Conn) bool {
+	msg := []byte("hello through the phantom")
+	if _, err := conn.Write(msg); err != nil {
+		return false
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return false
+	}
+	return bytes.Equal(buf, msg)
+}
+
+func TestEndToEnd(t *testing.T) {
+	station, err := fakestation.Start(startServer(t, startEcho(t), "127.0.0.0/8", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	if !echo(connect(t, station)) {
+		t.Error("expected data to be echoed through the phantom and the bridge")
+	}
+}
+
+func TestEndToEndDisallowedStation(t *testing.T) {
+	station, err := fakestation.Start(startServer(t, startEcho(t), "192.0.2.1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	if echo(connect(t, station)) {
+		t.Error("expected the bridge to reject a connection from a station that is not allowed")
+	}
+}
+
+func TestEndToEndStationAuth(t *testing.T) {
+	keys := stationauth.Keys{"station1": bytes.Repeat([]byte{1}, 32)}
+	for _, test := range []struct {
+		name  string
+		opts  []fakestation.Option
+		valid bool
+	}{
+		{
+			name:  "signed",
+			opts:  []fakestation.Option{fakestation.WithStationKey("station1", keys["station1"])},
+			valid: true,
+		},
+		{
+			name: "wrong key",
+			opts: []fakestation.Option{fakestation.WithStationKey("station1", bytes.Repeat([]byte{2}, 32))},
+		},
+		{
+			name: "unsigned",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			station, err := fakestation.Start(startServer(t, startEcho(t), "any", keys), test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer station.Close()
+
+			if ok := echo(connect(t, station)); ok != test.valid {
+				t.Errorf("expected connection to succeed: %v, got %v", test.valid, ok)
+			}
+		})
+	}
+}
+
+func TestEndToEndSession(t *testing.T) {
+	var orConns atomic.Int32
+	dial := dialOR(&pt.ServerInfo{OrAddr: startCountingEcho(t, &orConns)})
+	station, err := fakestation.Start(startUpstreamServer(t, dial, "127.0.0.0/8", nil, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer station.Close()
+
+	conn, err := conjure.NewSession(&conjure.ConjureConfig{
+		Registrars:    []string{"bdapi"},
+		RegisterURL:   station.URL,
+		Transport:     "min",
+		BridgeAddress: "192.0.2.1:80",
+		Session:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	if !echo(conn) {
+		t.Fatal("expected data to be echoed over the session")
+	}
+
+	// The stream should survive losing its phantom connection
+	station.DropConnections()
+	if !echo(conn) {
+		t.Fatal("expected the session to resume over a new phantom")
+	}
+	if n := station.Registrations(); n != 2 {
+		t.Errorf("expected 2 registrations, got %d", n)
+	}
+	// and keep using the same ORPort connection
+	if n := orConns.Load(); n != 1 {
+		t.Errorf("expected 1 ORPort connection, got %d", n)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/encapsulation"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/turbotunnel"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/session"
+)
+
+// sessionServer terminates the session layer for clients that opt into it.
+// Packets from all of a client's carrier connections are fed to one KCP
+// listener, which joins them into a KCP connection per ClientID. Each smux
+// stream on such a connection is proxied to the upstream like a plain
+// connection would be.
+type sessionServer struct {
+	dial  dialUpstream
+	pconn *turbotunnel.QueuePacketConn
+	ln    *kcp.Listener
+
+	lock sync.Mutex
+	// The client address of the latest carrier connection of each
+	// session, which is reported to tor for the session's streams
+	addrs map[turbotunnel.ClientID]string
+	// Open KCP connections, closed along with the server
+	conns map[*kcp.UDPSession]struct{}
+}
+
+func newSessionServer(localAddr net.Addr, dial dialUpstream) (*sessionServer, error) {
+	s := &sessionServer{
+		dial:  dial,
+		pconn: turbotunnel.NewQueuePacketConn(localAddr, session.KeepAliveTimeout, kcp.IKCP_MTU_DEF),
+		addrs: make(map[turbotunnel.ClientID]string),
+		conns: make(map[*kcp.UDPSession]struct{}),
+	}
+	ln, err := kcp.ServeConn(nil, 0, 0, s.pconn)
+	if err != nil {
+		s.pconn.Close()
+		return nil, err
+	}
+	s.ln = ln
+	go func() {
+		if err := s.acceptSessions(); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Printf("Error accepting sessions: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// Close stops accepting sessions and ends the open ones
+func (s *sessionServer) Close() error {
+	s.ln.Close()
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	return s.pconn.Close()
+}
+
+// handleCarrier exchanges packets over a carrier connection, whose Token
+// has already been read from r, until it fails.
+func (s *sessionServer) handleCarrier(conn net.Conn, r *bufio.Reader) error {
+	var clientID turbotunnel.ClientID
+	if _, err := io.ReadFull(r, clientID[:]); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.addrs[clientID] = conn.RemoteAddr().String()
+	s.lock.Unlock()
+	log.Printf("Session %s connected from %s", clientID, conn.RemoteAddr().String())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var p [2048]byte
+		for {
+			n, err := encapsulation.ReadData(r, p[:])
+			if err == io.ErrShortBuffer {
+				err = nil
+			}
+			if err != nil {
+				return
+			}
+			s.pconn.QueueIncoming(p[:n], clientID)
+		}
+	}()
+
+	// Buffer encapsulation.WriteData operations to keep length prefixes
+	// in the same send as the data that follows.
+	defer conn.Close()
+	bw := bufio.NewWriter(conn)
+	for {
+		select {
+		case <-done:
+			return nil
+		case p, ok := <-s.pconn.OutgoingQueue(clientID):
+			if !ok {
+				return nil
+			}
+			_, err := encapsulation.WriteData(bw, p)
+			s.pconn.Restore(p)
+			if err == nil {
+				err = bw.Flush()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *sessionServer) acceptSessions() error {
+	for {
+		conn, err := s.ln.AcceptKCP()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		session.ConfigureKCP(conn)
+		s.lock.Lock()
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+		go func() {
+			defer func() {
+				s.lock.Lock()
+				delete(s.conns, conn)
+				s.lock.Unlock()
+				conn.Close()
+			}()
+			if err := s.acceptStreams(conn); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Printf("Error accepting streams: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *sessionServer) acceptStreams(conn *kcp.UDPSession) error {
+	clientID := conn.RemoteAddr().(turbotunnel.ClientID)
+	defer func() {
+		s.lock.Lock()
+		delete(s.addrs, clientID)
+		s.lock.Unlock()
+	}()
+
+	sess, err := smux.Server(conn, session.SmuxConfig())
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		s.lock.Lock()
+		addr := s.addrs[clientID]
+		s.lock.Unlock()
+		go func() {
+			defer stream.Close()
+			handleClient(s.dial, stream, addr)
+		}()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	pp "github.com/pires/go-proxyproto"
+	pt "gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/goptlib"
+)
+
+const upstreamDialTimeout = 10 * time.Second
+
+// dialUpstream connects to the service that client connections are proxied
+// to. clientAddr is the address of the client, as reported by the station.
+type dialUpstream func(clientAddr string) (*net.TCPConn, error)
+
+// dialOR returns a dialUpstream for tor's ORPort, which reports client
+// addresses over the ExtORPort if tor set one up
+func dialOR(info *pt.ServerInfo) dialUpstream {
+	return func(clientAddr string) (*net.TCPConn, error) {
+		return pt.DialOr(info, clientAddr, "conjure")
+	}
+}
+
+// dialTCP returns a dialUpstream for a generic TCP service at addr. If
+// headerVersion is 1 or 2, each connection starts with a PROXY header of
+// that version carrying the client address.
+func dialTCP(addr string, headerVersion byte) dialUpstream {
+	return func(clientAddr string) (*net.TCPConn, error) {
+		conn, err := net.DialTimeout("tcp", addr, upstreamDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if headerVersion != 0 {
+			header := proxyHeader(headerVersion, clientAddr, conn.RemoteAddr().(*net.TCPAddr))
+			if _, err := header.WriteTo(conn); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn.(*net.TCPConn), nil
+	}
+}
+
+// proxyHeader builds a PROXY header from the client address to the
+// upstream. The upstream address is replaced by the unspecified address if
+// it is of a different family than the client's. If the client address is
+// unknown, the header is a LOCAL one.
+func proxyHeader(version byte, clientAddr string, upstreamAddr *net.TCPAddr) *pp.Header {
+	client, err := netip.ParseAddrPort(clientAddr)
+	if err != nil {
+		return pp.HeaderProxyFromAddrs(version, nil, nil)
+	}
+	src := net.TCPAddrFromAddrPort(netip.AddrPortFrom(client.Addr().Unmap(), client.Port()))
+	dst := upstreamAddr
+	if (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		dst = &net.TCPAddr{IP: net.IPv4zero}
+		if src.IP.To4() == nil {
+			dst = &net.TCPAddr{IP: net.IPv6zero}
+		}
+	}
+	return pp.HeaderProxyFromAddrs(version, src, dst)
+}
+
+// parseProxyHeaderVersion parses the -upstream-proxy-header option
+func parseProxyHeaderVersion(s string) (byte, error) {
+	switch s {
+	case "", "none":
+		return 0, nil
+	case "v1":
+		return 1, nil
+	case "v2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown PROXY header version %q, expected none, v1 or v2", s)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pp "github.com/pires/go-proxyproto"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/conjure/internal/fakestation"
+)
+
+// startProxyEcho starts an echo server behind a PROXY protocol listener,
+// standing in for a generic upstream. The client addresses reported in the
+// PROXY headers are sent on clients.
+func startProxyEcho(t *testing.T, clients chan<- net.Addr) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppln := &pp.Listener{Listener: ln, ReadHeaderTimeout: time.Second}
+	t.Cleanup(func() { ppln.Close() })
+	go func() {
+		for {
+			conn, err := ppln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				clients <- conn.RemoteAddr()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startBanner starts a server that sends banner as soon as a client connects,
+// standing in for an upstream that speaks first
+func startBanner(t *testing.T, banner string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, banner)
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestEndToEndUpstream(t *testing.T) {
+	t.Run("plain", func(t *testing.T) {
+		dial := dialTCP(startEcho(t).String(), 0)
+		station, err := fakestation.Start(startUpstreamServer(t, dial, "127.0.0.0/8", nil, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer station.Close()
+
+		if !echo(connect(t, station)) {
+			t.Error("expected data to be echoed by the upstream")
+		}
+	})
+
+	// The client only reads, so the banner has to reach it without the
+	// bridge waiting for the client to send anything
+	for _, sessions := range []bool{false, true} {
+		t.Run(fmt.Sprintf("server speaks first, sessions %v", sessions), func(t *testing.T) {
+			banner := "220 upstream ready\r\n"
+			dial := dialTCP(startBanner(t, banner), 0)
+			station, err := fakestation.Start(startUpstreamServer(t, dial, "127.0.0.0/8", nil, sessions))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer station.Close()
+
+			buf := make([]byte, len(banner))
+			if _, err := io.ReadFull(connect(t, station), buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != banner {
+				t.Errorf("expected banner %q, got %q", banner, buf)
+			}
+		})
+	}
+
+	for _, version := range []byte{1, 2} {
+		t.Run(fmt.Sprintf("proxy header v%d", version), func(t *testing.T) {
+			clients := make(chan net.Addr, 1)
+			dial := dialTCP(startProxyEcho(t, clients), version)
+			station, err := fakestation.Start(startUpstreamServer(t, dial, "127.0.0.0/8", nil, false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer station.Close()
+
+			conn := connect(t, station)
+			if !echo(conn) {
+				t.Fatal("expected data to be echoed by the upstream")
+			}
+			// The station reports the client's end of the phantom
+			// connection, which the upstream should see as well
+			client := (<-clients).(*net.TCPAddr)
+			if client.String() != conn.LocalAddr().String() {
+				t.Errorf("expected the upstream to see client %v, got %v", conn.LocalAddr(), client)
+			}
+		})
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	upstream4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 80}
+	upstream6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 80}
+	for _, test := range []struct {
+		client   string
+		upstream *net.TCPAddr
+		command  pp.ProtocolVersionAndCommand
+		proto    pp.AddressFamilyAndProtocol
+		dst      string
+	}{
+		{"198.51.100.1:1234", upstream4, pp.PROXY, pp.TCPv4, "192.0.2.10:80"},
+		{"[2001:db8::1]:1234", upstream6, pp.PROXY, pp.TCPv6, "[2001:db8::10]:80"},
+		{"198.51.100.1:1234", upstream6, pp.PROXY, pp.TCPv4, "0.0.0.0:0"},
+		{"[::ffff:198.51.100.1]:1234", upstream4, pp.PROXY, pp.TCPv4, "192.0.2.10:80"},
+		{"[2001:db8::1]:1234", upstream4, pp.PROXY, pp.TCPv6, "[::]:0"},
+		{"", upstream4, pp.LOCAL, pp.UNSPEC, ""},
+	} {
+		header := proxyHeader(2, test.client, test.upstream)
+		if header.Command != test.command || header.TransportProtocol != test.proto {
+			t.Errorf("%q to %v: unexpected header %+v", test.client, test.upstream, header)
+			continue
+		}
+		if test.command == pp.PROXY && header.DestinationAddr.String() != test.dst {
+			t.Errorf("%q to %v: expected destination %s, got %v", test.client, test.upstream, test.dst, header.DestinationAddr)
+		}
+		if _, err := header.Format(); err != nil {
+			t.Errorf("%q to %v: %v", test.client, test.upstream, err)
+		}
+	}
+}
+
+func TestParseProxyHeaderVersion(t *testing.T) {
+	for s, expected := range map[string]byte{"": 0, "none": 0, "v1": 1, "v2": 2} {
+		if version, err := parseProxyHeaderVersion(s); err != nil || version != expected {
+			t.Errorf("%q: expected version %d, got %d, %v", s, expected, version, err)
+		}
+	}
+	if _, err := parseProxyHeaderVersion("v3"); err == nil {
+		t.Error("expected v3 to be rejected")
+	}
+}